@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -12,17 +14,76 @@ import (
 
 	"wethu/internal/rooms"
 	"wethu/internal/hertzapi"
+	"wethu/internal/hertzws"
 )
 
+// version 服务器版本，构建时通过 -ldflags "-X main.version=..." 注入
+var version = "dev"
+
 func main() {
+	dataDir := flag.String("data-dir", "", "directory for persisted rooms; empty keeps rooms in memory only")
+	hostGrace := flag.Duration("host-grace", rooms.DefaultHostGracePeriod, "how long a disconnected host keeps the role before it is handed over")
+	reconnectGrace := flag.Duration("reconnect-grace", rooms.DefaultReconnectGrace, "how long a disconnected participant may reconnect with the same token")
+	maxIdle := flag.Duration("room-max-idle", rooms.DefaultReapPolicy.MaxIdle, "close rooms without any activity for this long (0 disables)")
+	maxLifetime := flag.Duration("room-max-lifetime", rooms.DefaultReapPolicy.MaxLifetime, "close rooms older than this (0 disables)")
+	maxEmpty := flag.Duration("room-max-empty", rooms.DefaultReapPolicy.MaxEmpty, "close rooms with nobody connected for this long (0 disables)")
+	tokenSecret := flag.String("token-secret", os.Getenv("WETHU_TOKEN_SECRET"), "HMAC secret for session tokens (default $WETHU_TOKEN_SECRET); empty generates one per start")
+	tokenTTL := flag.Duration("token-ttl", rooms.DefaultTokenTTL, "how long a session token stays valid before it must be refreshed")
+	maxRooms := flag.Int("max-rooms", rooms.DefaultMaxRooms, "maximum number of rooms on this server (0 disables)")
+	maxParticipants := flag.Int("max-participants", rooms.DefaultMaxParticipants, "default and maximum participants per room (0 disables)")
+	createRate := flag.Int("create-rate", rooms.DefaultCreateRateLimit, "rooms a single IP may create per -create-window (0 disables)")
+	createWindow := flag.Duration("create-window", rooms.DefaultCreateRateWindow, "time window for -create-rate")
+	pingInterval := flag.Duration("ws-ping-interval", hertzws.DefaultPingInterval, "interval between WebSocket heartbeat pings (0 disables)")
+	pongWait := flag.Duration("ws-pong-wait", hertzws.DefaultPongWait, "close WebSocket connections silent for this long, pongs included (0 disables)")
+	writeWait := flag.Duration("ws-write-wait", rooms.DefaultWriteWait, "timeout for a single WebSocket write")
+	helloTimeout := flag.Duration("ws-hello-timeout", hertzws.DefaultHelloTimeout, "close WebSocket connections that do not send HELLO within this time (0 disables)")
+	maxMessageBytes := flag.Int64("ws-max-message-bytes", hertzws.DefaultMaxMessageBytes, "maximum size of a single inbound WebSocket message (0 disables)")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated CIDRs of reverse proxies whose X-Forwarded-For/X-Real-IP headers are trusted; empty uses the peer address")
+	flag.Parse()
+
 	// 创建房间管理器
-	roomManager := rooms.NewManager()
+	managerOpts := []rooms.Option{
+		rooms.WithHostGracePeriod(*hostGrace),
+		rooms.WithReconnectGrace(*reconnectGrace),
+		rooms.WithReapPolicy(rooms.ReapPolicy{
+			MaxIdle:     *maxIdle,
+			MaxLifetime: *maxLifetime,
+			MaxEmpty:    *maxEmpty,
+		}),
+		rooms.WithTokenTTL(*tokenTTL),
+		rooms.WithRoomLimit(*maxRooms),
+		rooms.WithParticipantLimit(*maxParticipants),
+		rooms.WithCreateRateLimit(*createRate, *createWindow),
+	}
+	if *tokenSecret != "" {
+		managerOpts = append(managerOpts, rooms.WithTokenSecret([]byte(*tokenSecret)))
+	} else {
+		log.Println("No token secret configured; session tokens will not survive a restart")
+	}
+	if *dataDir != "" {
+		store, err := rooms.NewFileStore(*dataDir)
+		if err != nil {
+			log.Fatalf("Failed to open room store: %v", err)
+		}
+		managerOpts = append(managerOpts, rooms.WithStore(store))
+	}
+	roomManager := rooms.NewManager(managerOpts...)
 	
 	// 创建Hertz服务器
 	serverConfig := server.Default(server.WithHostPorts(":8080"))
 	
 	// 初始化API路由
-	router := hertzapi.NewRouter(serverConfig, roomManager)
+	router := hertzapi.NewRouter(serverConfig, roomManager,
+		hertzws.WithPingInterval(*pingInterval),
+		hertzws.WithPongWait(*pongWait),
+		hertzws.WithWriteWait(*writeWait),
+		hertzws.WithHelloTimeout(*helloTimeout),
+		hertzws.WithMaxMessageBytes(*maxMessageBytes),
+		hertzws.WithServerVersion(version),
+	)
+	if err := hertzapi.SetTrustedProxies(router, strings.Split(*trustedProxies, ",")); err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
 	
 	// 启动服务器
 	go func() {
@@ -44,6 +105,7 @@ func main() {
 	if err := router.Shutdown(ctx); err != nil {
 		log.Printf("Graceful shutdown failed: %v\n", err)
 	}
+	roomManager.Close()
 
 	log.Println("Server stopped")
 }
@@ -2,6 +2,12 @@ package hertzapi
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
 	"github.com/RanFeng/ilog"
 
 	"github.com/cloudwego/hertz/pkg/app"
@@ -9,13 +15,20 @@ import (
 	"github.com/cloudwego/hertz/pkg/protocol/consts"
 
 	"wethu/internal/hertzws"
+	"wethu/internal/protocol"
 	"wethu/internal/rooms"
 )
 
-// NewRouter 初始化Hertz路由
-func NewRouter(h *server.Hertz, roomManager *rooms.Manager) *server.Hertz {
+// NewRouter 初始化Hertz路由，wsOpts 用于配置 WebSocket 心跳等参数
+func NewRouter(h *server.Hertz, roomManager *rooms.Manager, wsOpts ...hertzws.HandlerOption) *server.Hertz {
 	// 创建WebSocket处理器
-	wsHandler := hertzws.NewHandler(roomManager)
+	wsHandler := hertzws.NewHandler(roomManager, wsOpts...)
+	// 被替换或判定为慢消费者的连接在读循环退出前就会结束处理函数，
+	// 不复用 hijackConn，避免 Hertz 回收时与仍在读取的 goroutine 竞争
+	h.NoHijackConnPool = true
+
+	// 默认不信任任何代理，客户端 IP 取连接的对端地址，见 SetTrustedProxies
+	h.SetClientIPFunc(clientIPFunc(nil))
 
 	// 注册中间件
 	h.Use(recoveryMiddleware())
@@ -35,6 +48,12 @@ func NewRouter(h *server.Hertz, roomManager *rooms.Manager) *server.Hertz {
 			roomsGroup.POST("/create", handleCreateRoom(roomManager))
 			roomsGroup.POST("/join/:roomId", handleJoinRoom(roomManager))
 			roomsGroup.GET("/:roomId", handleGetRoom(roomManager))
+			roomsGroup.GET("/:roomId/chat", handleGetChat(roomManager))
+			roomsGroup.GET("/:roomId/playlist", handleGetPlaylist(roomManager))
+			roomsGroup.GET("/:roomId/participants", handleGetParticipants(roomManager))
+			roomsGroup.POST("/:roomId/token/refresh", handleRefreshToken(roomManager))
+			roomsGroup.POST("/:roomId/invites", handleCreateInvite(roomManager))
+			roomsGroup.GET("/:roomId/audit", handleGetAudit(roomManager))
 		}
 	}
 
@@ -44,6 +63,40 @@ func NewRouter(h *server.Hertz, roomManager *rooms.Manager) *server.Hertz {
 	return h
 }
 
+// SetTrustedProxies 设置可信反向代理的网段（CIDR 或单个 IP）。只有对端地址属于这些网段时，
+// 才采用 X-Forwarded-For / X-Real-IP 中的客户端 IP 做创建限流与封禁；为空时只使用对端地址
+func SetTrustedProxies(h *server.Hertz, proxies []string) error {
+	var trusted []*net.IPNet
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		trusted = append(trusted, cidr)
+	}
+	h.SetClientIPFunc(clientIPFunc(trusted))
+	return nil
+}
+
+// clientIPFunc 返回只信任 trusted 网段转发头的 ClientIP 实现；Hertz 默认信任所有来源的转发头，客户端可以伪造
+func clientIPFunc(trusted []*net.IPNet) app.ClientIP {
+	return app.ClientIPWithOption(app.ClientIPOptions{
+		RemoteIPHeaders: []string{"X-Forwarded-For", "X-Real-IP"},
+		TrustedCIDRs:    trusted,
+	})
+}
+
 // recoveryMiddleware 恢复中间件
 func recoveryMiddleware() app.HandlerFunc {
 	return func(c context.Context, ctx *app.RequestContext) {
@@ -77,10 +130,27 @@ func handleCreateRoom(roomManager *rooms.Manager) app.HandlerFunc {
 			return
 		}
 
-		session, err := roomManager.CreateRoom(payload.DisplayName, payload.VideoURL)
+		settings := protocol.RoomSettings{
+			AutoPauseOnHostLeave: payload.AutoPauseOnHostLeave,
+			WaitingRoom:          payload.WaitingRoom,
+		}
+		session, err := roomManager.CreateRoom(payload.DisplayName, payload.VideoURL,
+			rooms.WithRoomSettings(settings), rooms.WithRoomPassword(payload.Password),
+			rooms.WithCapacity(payload.MaxParticipants), rooms.WithCreatorIP(ctx.ClientIP()))
 		ilog.EventInfo(c, "CreateRoom", "session", session)
 		if err != nil {
-			respondError(ctx, consts.StatusInternalServerError, "create_failed", err.Error())
+			switch err {
+			case rooms.ErrInvalidPassword:
+				respondError(ctx, consts.StatusBadRequest, "invalid_password", err.Error())
+			case rooms.ErrInvalidCapacity:
+				respondError(ctx, consts.StatusBadRequest, "invalid_capacity", err.Error())
+			case rooms.ErrCreateRateLimited:
+				respondError(ctx, consts.StatusTooManyRequests, "quota_exceeded", err.Error())
+			case rooms.ErrRoomLimitReached:
+				respondError(ctx, consts.StatusServiceUnavailable, "quota_exceeded", err.Error())
+			default:
+				respondError(ctx, consts.StatusInternalServerError, "create_failed", err.Error())
+			}
 			return
 		}
 
@@ -103,15 +173,32 @@ func handleJoinRoom(roomManager *rooms.Manager) app.HandlerFunc {
 			return
 		}
 
-		ilog.EventInfo(c, "JoinRoom_start", "request", payload)
+		ilog.EventInfo(c, "JoinRoom_start", "roomID", roomID, "displayName", payload.DisplayName)
 
-		session, err := roomManager.JoinRoom(roomID, payload.DisplayName)
+		session, err := roomManager.JoinRoom(roomID, payload.DisplayName,
+			rooms.WithJoinPassword(payload.Password), rooms.WithInvite(payload.Invite),
+			rooms.WithClientIP(ctx.ClientIP()), rooms.WithClientFingerprint(payload.Fingerprint))
 		if err != nil {
-			if err == rooms.ErrRoomNotFound {
+			switch err {
+			case rooms.ErrRoomNotFound:
 				respondError(ctx, consts.StatusNotFound, "room_not_found", err.Error())
-				return
+			case rooms.ErrBanned:
+				respondError(ctx, consts.StatusForbidden, "banned", err.Error())
+			case rooms.ErrRoomFull:
+				respondError(ctx, consts.StatusConflict, "room_full", err.Error())
+			case rooms.ErrWrongPassword:
+				respondError(ctx, consts.StatusForbidden, "wrong_password", err.Error())
+			case rooms.ErrPasswordRateLimited:
+				respondError(ctx, consts.StatusTooManyRequests, "too_many_attempts", err.Error())
+			case rooms.ErrInviteNotFound:
+				respondError(ctx, consts.StatusForbidden, "invite_not_found", err.Error())
+			case rooms.ErrInviteExpired:
+				respondError(ctx, consts.StatusForbidden, "invite_expired", err.Error())
+			case rooms.ErrInviteExhausted:
+				respondError(ctx, consts.StatusForbidden, "invite_exhausted", err.Error())
+			default:
+				respondError(ctx, consts.StatusInternalServerError, "join_failed", err.Error())
 			}
-			respondError(ctx, consts.StatusInternalServerError, "join_failed", err.Error())
 			return
 		}
 		ilog.EventInfo(c, "JoinRoom_end", "session", session)
@@ -120,10 +207,13 @@ func handleJoinRoom(roomManager *rooms.Manager) app.HandlerFunc {
 	}
 }
 
-// handleGetRoom 获取房间状态处理函数
+// handleGetRoom 获取房间状态处理函数，需要房间成员的 Authorization: Bearer 令牌
 func handleGetRoom(roomManager *rooms.Manager) app.HandlerFunc {
 	return func(c context.Context, ctx *app.RequestContext) {
 		roomID := ctx.Param("roomId")
+		if !requireMember(roomManager, ctx, roomID) {
+			return
+		}
 		state, err := roomManager.GetState(roomID)
 		if err != nil {
 			if err == rooms.ErrRoomNotFound {
@@ -138,14 +228,251 @@ func handleGetRoom(roomManager *rooms.Manager) app.HandlerFunc {
 	}
 }
 
+// handleGetChat 获取房间最近聊天记录处理函数，需要房间成员的令牌
+func handleGetChat(roomManager *rooms.Manager) app.HandlerFunc {
+	return func(c context.Context, ctx *app.RequestContext) {
+		roomID := ctx.Param("roomId")
+		if !requireMember(roomManager, ctx, roomID) {
+			return
+		}
+		messages, err := roomManager.GetChatHistory(roomID)
+		if err != nil {
+			if err == rooms.ErrRoomNotFound {
+				respondError(ctx, consts.StatusNotFound, "room_not_found", err.Error())
+				return
+			}
+			respondError(ctx, consts.StatusInternalServerError, "chat_fetch_failed", err.Error())
+			return
+		}
+
+		ctx.JSON(consts.StatusOK, protocol.ChatHistory{Messages: messages})
+	}
+}
+
+// handleGetPlaylist 获取房间播放列表处理函数，需要房间成员的令牌
+func handleGetPlaylist(roomManager *rooms.Manager) app.HandlerFunc {
+	return func(c context.Context, ctx *app.RequestContext) {
+		roomID := ctx.Param("roomId")
+		if !requireMember(roomManager, ctx, roomID) {
+			return
+		}
+		playlist, err := roomManager.GetPlaylist(roomID)
+		if err != nil {
+			if err == rooms.ErrRoomNotFound {
+				respondError(ctx, consts.StatusNotFound, "room_not_found", err.Error())
+				return
+			}
+			respondError(ctx, consts.StatusInternalServerError, "playlist_fetch_failed", err.Error())
+			return
+		}
+
+		ctx.JSON(consts.StatusOK, playlist)
+	}
+}
+
+// handleGetParticipants 获取房间成员列表处理函数，需要房间成员的令牌
+func handleGetParticipants(roomManager *rooms.Manager) app.HandlerFunc {
+	return func(c context.Context, ctx *app.RequestContext) {
+		roomID := ctx.Param("roomId")
+		if !requireMember(roomManager, ctx, roomID) {
+			return
+		}
+		roster, err := roomManager.GetRoster(roomID)
+		if err != nil {
+			if err == rooms.ErrRoomNotFound {
+				respondError(ctx, consts.StatusNotFound, "room_not_found", err.Error())
+				return
+			}
+			respondError(ctx, consts.StatusInternalServerError, "participants_fetch_failed", err.Error())
+			return
+		}
+
+		ctx.JSON(consts.StatusOK, roster)
+	}
+}
+
+// handleRefreshToken 刷新会话令牌处理函数，令牌可放在 Authorization: Bearer 头或请求体中
+func handleRefreshToken(roomManager *rooms.Manager) app.HandlerFunc {
+	return func(c context.Context, ctx *app.RequestContext) {
+		roomID := ctx.Param("roomId")
+		token := bearerToken(ctx)
+		if token == "" {
+			var payload refreshTokenRequest
+			if err := ctx.Bind(&payload); err != nil {
+				respondError(ctx, consts.StatusBadRequest, "invalid_request", "Invalid request body")
+				return
+			}
+			token = payload.Token
+		}
+		if token == "" {
+			respondError(ctx, consts.StatusUnauthorized, "invalid_token", "token is required")
+			return
+		}
+
+		grant, err := roomManager.RefreshToken(roomID, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, rooms.ErrTokenExpired):
+				respondError(ctx, consts.StatusUnauthorized, "token_expired", err.Error())
+			case errors.Is(err, rooms.ErrInvalidToken):
+				respondError(ctx, consts.StatusUnauthorized, "invalid_token", err.Error())
+			case errors.Is(err, rooms.ErrBanned):
+				respondError(ctx, consts.StatusForbidden, "banned", err.Error())
+			case errors.Is(err, rooms.ErrRoomNotFound):
+				respondError(ctx, consts.StatusNotFound, "room_not_found", err.Error())
+			default:
+				respondError(ctx, consts.StatusInternalServerError, "refresh_failed", err.Error())
+			}
+			return
+		}
+
+		ctx.JSON(consts.StatusOK, grant)
+	}
+}
+
+// handleCreateInvite 生成邀请链接处理函数，需要 Authorization: Bearer 令牌
+func handleCreateInvite(roomManager *rooms.Manager) app.HandlerFunc {
+	return func(c context.Context, ctx *app.RequestContext) {
+		roomID := ctx.Param("roomId")
+		token := bearerToken(ctx)
+		if token == "" {
+			respondError(ctx, consts.StatusUnauthorized, "invalid_token", "token is required")
+			return
+		}
+		var payload createInviteRequest
+		if err := ctx.Bind(&payload); err != nil {
+			respondError(ctx, consts.StatusBadRequest, "invalid_request", "Invalid request body")
+			return
+		}
+
+		ttl := time.Duration(payload.ExpiresInSeconds) * time.Second
+		invite, err := roomManager.CreateInvite(roomID, token, ttl, payload.MaxUses)
+		if err != nil {
+			var permErr *rooms.PermissionError
+			switch {
+			case errors.Is(err, rooms.ErrTokenExpired):
+				respondError(ctx, consts.StatusUnauthorized, "token_expired", err.Error())
+			case errors.Is(err, rooms.ErrInvalidToken):
+				respondError(ctx, consts.StatusUnauthorized, "invalid_token", err.Error())
+			case errors.Is(err, rooms.ErrBanned):
+				respondError(ctx, consts.StatusForbidden, "banned", err.Error())
+			case errors.Is(err, rooms.ErrRoomNotFound):
+				respondError(ctx, consts.StatusNotFound, "room_not_found", err.Error())
+			case errors.As(err, &permErr):
+				respondError(ctx, consts.StatusForbidden, "missing_"+permErr.Permission+"_permission", err.Error())
+			case errors.Is(err, rooms.ErrInvalidInvite):
+				respondError(ctx, consts.StatusBadRequest, "invalid_invite", err.Error())
+			default:
+				respondError(ctx, consts.StatusInternalServerError, "invite_failed", err.Error())
+			}
+			return
+		}
+
+		ctx.JSON(consts.StatusCreated, invite)
+	}
+}
+
+// handleGetAudit 获取房间管理操作记录处理函数，需要 Authorization: Bearer 令牌及 kick 权限
+func handleGetAudit(roomManager *rooms.Manager) app.HandlerFunc {
+	return func(c context.Context, ctx *app.RequestContext) {
+		roomID := ctx.Param("roomId")
+		token := bearerToken(ctx)
+		if token == "" {
+			respondError(ctx, consts.StatusUnauthorized, "invalid_token", "token is required")
+			return
+		}
+
+		entries, err := roomManager.GetAuditTrail(roomID, token)
+		if err != nil {
+			var permErr *rooms.PermissionError
+			switch {
+			case errors.Is(err, rooms.ErrTokenExpired):
+				respondError(ctx, consts.StatusUnauthorized, "token_expired", err.Error())
+			case errors.Is(err, rooms.ErrInvalidToken):
+				respondError(ctx, consts.StatusUnauthorized, "invalid_token", err.Error())
+			case errors.Is(err, rooms.ErrBanned):
+				respondError(ctx, consts.StatusForbidden, "banned", err.Error())
+			case errors.Is(err, rooms.ErrRoomNotFound):
+				respondError(ctx, consts.StatusNotFound, "room_not_found", err.Error())
+			case errors.As(err, &permErr):
+				respondError(ctx, consts.StatusForbidden, "missing_"+permErr.Permission+"_permission", err.Error())
+			default:
+				respondError(ctx, consts.StatusInternalServerError, "audit_fetch_failed", err.Error())
+			}
+			return
+		}
+
+		ctx.JSON(consts.StatusOK, protocol.AuditTrail{Entries: entries})
+	}
+}
+
+// requireMember 校验 Authorization: Bearer 令牌属于房间中已入场的成员，失败时写入错误响应并返回 false
+func requireMember(roomManager *rooms.Manager, ctx *app.RequestContext, roomID string) bool {
+	token := bearerToken(ctx)
+	if token == "" {
+		respondError(ctx, consts.StatusUnauthorized, "invalid_token", "token is required")
+		return false
+	}
+	err := roomManager.AuthorizeRead(roomID, token)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, rooms.ErrTokenExpired):
+		respondError(ctx, consts.StatusUnauthorized, "token_expired", err.Error())
+	case errors.Is(err, rooms.ErrInvalidToken):
+		respondError(ctx, consts.StatusUnauthorized, "invalid_token", err.Error())
+	case errors.Is(err, rooms.ErrBanned):
+		respondError(ctx, consts.StatusForbidden, "banned", err.Error())
+	case errors.Is(err, rooms.ErrAwaitingAdmission):
+		respondError(ctx, consts.StatusForbidden, "awaiting_admission", err.Error())
+	case errors.Is(err, rooms.ErrRoomNotFound):
+		respondError(ctx, consts.StatusNotFound, "room_not_found", err.Error())
+	default:
+		respondError(ctx, consts.StatusInternalServerError, "authorize_failed", err.Error())
+	}
+	return false
+}
+
+// bearerToken 读取 Authorization: Bearer 头中的令牌
+func bearerToken(ctx *app.RequestContext) string {
+	header := string(ctx.GetHeader("Authorization"))
+	const prefix = "Bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
 // 请求结构体定义
 type createRoomRequest struct {
-	DisplayName string `json:"displayName"`
-	VideoURL    string `json:"videoUrl"`
+	DisplayName          string `json:"displayName"`
+	VideoURL             string `json:"videoUrl"`
+	AutoPauseOnHostLeave bool   `json:"autoPauseOnHostLeave"`
+	WaitingRoom          bool   `json:"waitingRoom"`
+	// Password 房间密码，可选
+	Password string `json:"password,omitempty"`
+	// MaxParticipants 房间成员数上限，0 表示使用服务器上限
+	MaxParticipants int `json:"maxParticipants,omitempty"`
 }
 
 type joinRoomRequest struct {
 	DisplayName string `json:"displayName"`
+	Password    string `json:"password,omitempty"`
+	// Invite 邀请码，有效时无需密码
+	Invite string `json:"invite,omitempty"`
+	// Fingerprint 客户端设备指纹，可选，用于封禁
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+type createInviteRequest struct {
+	// ExpiresInSeconds 有效期（秒），为 0 时使用默认有效期
+	ExpiresInSeconds int64 `json:"expiresInSeconds"`
+	// MaxUses 最多可使用次数，为 0 表示不限
+	MaxUses int `json:"maxUses"`
+}
+
+type refreshTokenRequest struct {
+	Token string `json:"token"`
 }
 
 // respondError 返回错误响应
@@ -3,8 +3,10 @@ package hertzws
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
-	"sync"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/RanFeng/ilog"
@@ -20,20 +22,102 @@ import (
 type Handler struct {
 	manager  *rooms.Manager
 	upgrader websocket.HertzUpgrader
+	// pingInterval 发送 ping 的间隔，pongWait 等待对端任意消息（含 pong）的最长时间，
+	// writeWait 单次写入超时
+	pingInterval time.Duration
+	pongWait     time.Duration
+	writeWait    time.Duration
+	// helloTimeout 等待客户端 HELLO 的最长时间，maxMessageBytes 单条入站消息的最大字节数
+	helloTimeout    time.Duration
+	maxMessageBytes int64
+	// serverVersion 在 WELCOME 中告知客户端的服务器版本
+	serverVersion string
+}
+
+const (
+	// DefaultPongWait 超过该时间没有收到对端任何消息（含 pong）即视为连接已失效
+	DefaultPongWait = 60 * time.Second
+	// DefaultPingInterval 发送 ping 的默认间隔，需小于 pong 等待时间
+	DefaultPingInterval = DefaultPongWait * 9 / 10
+	// DefaultHelloTimeout 连接建立后等待 HELLO 的默认时间
+	DefaultHelloTimeout = 10 * time.Second
+	// DefaultMaxMessageBytes 单条入站消息的默认最大字节数
+	DefaultMaxMessageBytes = 64 << 10
+)
+
+// HandlerOption 配置 Handler 的可选项
+type HandlerOption func(*Handler)
+
+// WithPingInterval 设置心跳 ping 的发送间隔，<=0 表示不发送
+func WithPingInterval(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.pingInterval = d
+	}
+}
+
+// WithPongWait 设置等待对端消息的超时，<=0 表示不设读超时
+func WithPongWait(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.pongWait = d
+	}
+}
+
+// WithWriteWait 设置单次写入超时
+func WithWriteWait(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.writeWait = d
+	}
+}
+
+// WithHelloTimeout 设置等待 HELLO 的超时，<=0 表示一直等待
+func WithHelloTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.helloTimeout = d
+	}
+}
+
+// WithMaxMessageBytes 设置单条入站消息的最大字节数，<=0 表示不限
+func WithMaxMessageBytes(n int64) HandlerOption {
+	return func(h *Handler) {
+		h.maxMessageBytes = n
+	}
+}
+
+// WithServerVersion 设置在 WELCOME 中告知客户端的服务器版本
+func WithServerVersion(version string) HandlerOption {
+	return func(h *Handler) {
+		h.serverVersion = version
+	}
 }
 
 // NewHandler 创建新的WebSocket处理器
-func NewHandler(manager *rooms.Manager) *Handler {
-	return &Handler{
-		manager: manager,
+func NewHandler(manager *rooms.Manager, opts ...HandlerOption) *Handler {
+	h := &Handler{
+		manager:         manager,
+		pingInterval:    DefaultPingInterval,
+		pongWait:        DefaultPongWait,
+		writeWait:       rooms.DefaultWriteWait,
+		helloTimeout:    DefaultHelloTimeout,
+		maxMessageBytes: DefaultMaxMessageBytes,
+		serverVersion:   "dev",
 		upgrader: websocket.HertzUpgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
+			// 客户端在 Sec-WebSocket-Protocol 中声明可用的编码，未声明时使用 JSON
+			Subprotocols: protocol.Subprotocols,
 			CheckOrigin: func(ctx *app.RequestContext) bool {
 				return true
 			},
 		},
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.pongWait > 0 && h.pingInterval >= h.pongWait {
+		// ping 间隔不小于等待时间时，正常连接也会在两次 ping 之间超时
+		h.pingInterval = h.pongWait * 9 / 10
+	}
+	return h
 }
 
 // HandleWebSocket 处理WebSocket连接
@@ -41,6 +125,12 @@ func (h *Handler) HandleWebSocket(c context.Context, ctx *app.RequestContext) {
 
 	roomID := ctx.Param("roomId")
 	token := ctx.Query("token")
+	if token == "" {
+		// 非浏览器客户端可以通过 Authorization 头传递令牌，避免令牌出现在 URL 中
+		if header := string(ctx.GetHeader("Authorization")); strings.HasPrefix(header, "Bearer ") {
+			token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		}
+	}
 
 	if token == "" {
 		log.Printf("WebSocket: missing token for room %s", roomID)
@@ -48,7 +138,7 @@ func (h *Handler) HandleWebSocket(c context.Context, ctx *app.RequestContext) {
 		return
 	}
 
-	ilog.EventInfo(c, "WebSocket_start", "roomID", roomID, "token", token)
+	ilog.EventInfo(c, "WebSocket_start", "roomID", roomID)
 
 	// 查找房间和参与者
 	room, participant, err := h.manager.LookupParticipant(roomID, token)
@@ -64,34 +154,66 @@ func (h *Handler) HandleWebSocket(c context.Context, ctx *app.RequestContext) {
 		//ctxWithTimeout, cancel := context.WithTimeout(c, 24*time.Hour)
 		//defer cancel()
 
-		ilog.EventInfo(c, "WebSocket_upgrade", "room", roomID, "token", token)
+		codec := protocol.CodecFor(conn.Subprotocol())
+		ilog.EventInfo(c, "WebSocket_upgrade", "room", roomID, "user", participant.ID, "codec", codec.Name())
+		if h.maxMessageBytes > 0 {
+			conn.SetReadLimit(h.maxMessageBytes)
+		}
+
+		// 握手完成前连接不绑定到参与者，收不到任何房间事件
+		features, ok := h.handshake(c, room, participant, conn, codec)
+		if !ok {
+			_ = conn.Close()
+			return
+		}
 
-		// 设置读取超时
-		//err = conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		//if err != nil {
-		//	ilog.EventError(c, err, "WebSocket: set deadline failed", "room", roomID)
-		//}
+		// 设置读取超时，收到 pong 或任意消息时顺延
+		setReadTimeout(conn, 0)
+		h.extendReadDeadline(conn)
+		conn.SetPongHandler(func(string) error {
+			h.extendReadDeadline(conn)
+			return nil
+		})
 
 		// 绑定连接到参与者
-		participant.BindConnection(conn)
+		participant.BindConnection(conn, codec, features)
+		room.MarkConnected(participant.ID)
 
 		// 启动发送循环
 		sendDone := make(chan struct{})
 		go func() {
-			participant.SendLoop()
+			participant.SendLoop(h.writeWait)
 			close(sendDone)
 		}()
 
-		// 发送房间状态
-		participant.Send(protocol.Envelope{
-			Kind: "ROOM_STATE",
-			Data: protocol.RoomStatePayload{Room: room.StateSnapshot()},
-		})
+		// 心跳：定期发送 ping，写失败说明连接已断开
+		stopPing := make(chan struct{})
+		defer close(stopPing)
+		go h.pingLoop(c, participant, conn, stopPing)
+
+		if room.IsPending(participant.ID) {
+			// 等候室中只告知等待审批，批准后再发送房间快照；被拒绝时发送循环随队列关闭而退出
+			participant.Send(protocol.Envelope{
+				Kind: "ADMISSION_PENDING",
+				Data: protocol.AdmissionPending{RoomID: room.ID()},
+			})
+			admitted := room.Admitted(participant.ID)
+			go func() {
+				select {
+				case <-admitted:
+					h.sendSnapshot(room, participant)
+				case <-sendDone:
+				}
+			}()
+		} else {
+			// 发送房间完整快照
+			h.sendSnapshot(room, participant)
+		}
 
 		// 启动接收消息循环
 		readDone := make(chan struct{})
 		go func() {
-			h.readLoop(c, room, participant, conn)
+			h.readLoop(c, room, participant, conn, codec)
 			close(readDone)
 		}()
 
@@ -100,11 +222,11 @@ func (h *Handler) HandleWebSocket(c context.Context, ctx *app.RequestContext) {
 		go func() {
 			select {
 			case <-readDone:
-				ilog.EventInfo(c, "WebSocket_read_done", "room", roomID, "token", token)
+				ilog.EventInfo(c, "WebSocket_read_done", "room", roomID, "user", participant.ID)
 			case <-sendDone:
-				ilog.EventInfo(c, "WebSocket_send_done", "room", roomID, "token", token)
+				ilog.EventInfo(c, "WebSocket_send_done", "room", roomID, "user", participant.ID)
 				//case <-ctxWithTimeout.Done():
-				//	ilog.EventInfo(c, "WebSocket_timeout_done", "room", roomID, "token", token)
+				//	ilog.EventInfo(c, "WebSocket_timeout_done", "room", roomID, "user", participant.ID)
 			}
 			close(waitForCompletion)
 		}()
@@ -112,11 +234,10 @@ func (h *Handler) HandleWebSocket(c context.Context, ctx *app.RequestContext) {
 		select {
 		case <-waitForCompletion:
 			// 确保连接关闭
-			conn.Close()
-			// 连接关闭后清理
-			ilog.EventInfo(c, "WebSocket_close", "room", roomID, "token", token)
-			//room.DetachParticipant(participant.ID)
-			//h.manager.CleanupRoom(room)
+			participant.Release(conn)
+			// 连接关闭后进入重连宽限期，过期后由 Manager 的后台清理移除参与者并回收空房间
+			ilog.EventInfo(c, "WebSocket_close", "room", roomID, "user", participant.ID)
+			room.MarkDisconnected(participant.ID)
 		}
 	})
 
@@ -126,66 +247,95 @@ func (h *Handler) HandleWebSocket(c context.Context, ctx *app.RequestContext) {
 	}
 }
 
-// readLoop 读取WebSocket消息循环
-func (h *Handler) readLoop(ctx context.Context, room *rooms.Room, participant *rooms.Participant, conn *websocket.Conn) {
-	defer participant.Close()
-
-	// 预分配消息缓冲区以减少内存分配
-	messagePool := sync.Pool{
-		New: func() interface{} {
-			b := make([]byte, 8192)
-			return &b
-		},
-	}
+// readLoop 读取WebSocket消息循环，按连接协商的 codec 解析入站信封
+func (h *Handler) readLoop(ctx context.Context, room *rooms.Room, participant *rooms.Participant, conn *websocket.Conn, codec protocol.Codec) {
+	defer participant.Release(conn)
 
 	for {
 		//ilog.EventInfo(ctx, "read_loop_default")
 		// 读取消息
 		msgType, data, err := conn.ReadMessage()
+		receivedAt := time.Now()
 		if err != nil {
-			ilog.EventError(ctx, err, "conn: read message failed", "room", room.ID)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// 读超时意味着在 pongWait 内既没有消息也没有 pong，按断线处理
+				ilog.EventInfo(ctx, "WebSocket_heartbeat_timeout", "room", room.ID(), "user", participant.ID, "pong_wait", h.pongWait.String())
+				break
+			}
+			ilog.EventError(ctx, err, "conn: read message failed", "room", room.ID(), "user", participant.ID)
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure) {
 				log.Printf("WebSocket: read error: %v", err)
 			}
 			break
 		}
+		h.extendReadDeadline(conn)
 
-		// 只处理文本消息
-		if msgType != websocket.TextMessage {
+		// 只处理数据帧，帧类型需与协商的编码一致
+		if msgType != websocket.TextMessage && msgType != websocket.BinaryMessage {
+			continue
+		}
+		if (msgType == websocket.BinaryMessage) != codec.Binary() {
+			log.Printf("WebSocket: unexpected frame type %d for codec %s", msgType, codec.Name())
 			continue
 		}
 
-		// 使用缓冲区处理消息以提高性能
-		var inbound protocol.InboundEnvelope
-		if len(data) > 8192 {
-			// 对于大消息，直接解析
-			if err := json.Unmarshal(data, &inbound); err != nil {
-				log.Printf("WebSocket: unmarshal large message error: %v", err)
-				continue
-			}
-		} else {
-			// 对于小消息，使用对象池减少GC压力
-			bufferPtr := messagePool.Get().(*[]byte)
-			buffer := *bufferPtr
-			if len(buffer) < len(data) {
-				// 如果缓冲区太小，扩容
-				buffer = make([]byte, len(data))
-			}
-			copy(buffer, data)
-			if err := json.Unmarshal(buffer[:len(data)], &inbound); err != nil {
-				log.Printf("WebSocket: unmarshal message error: %v", err)
-				messagePool.Put(bufferPtr)
-				continue
-			}
-			messagePool.Put(bufferPtr)
+		inbound, err := codec.DecodeInbound(data)
+		if err != nil {
+			log.Printf("WebSocket: decode message error: %v", err)
+			continue
+		}
+
+		// 等候室中只允许校时
+		if inbound.Kind != "TIME_PING" && room.IsPending(participant.ID) {
+			h.sendError(participant, rooms.ErrAwaitingAdmission, "awaiting_admission")
+			continue
 		}
 
 		// 根据消息类型处理
 		switch inbound.Kind {
 		case "CONTROL":
 			h.handleControlMessage(room, participant, inbound.Data)
+		case "COMMAND":
+			h.handleCommand(room, participant, inbound.Data)
 		case "SYNC_REQUEST":
 			h.handleSyncRequest(room, participant, inbound.Data)
+		case "RESUME":
+			h.handleResume(room, participant, inbound.Data)
+		case "TRANSFER_HOST":
+			h.handleTransferHost(room, participant, inbound.Data)
+		case "GRANT_ROLE":
+			h.handleGrantRole(room, participant, inbound.Data)
+		case "REVOKE_ROLE":
+			h.handleRevokeRole(room, participant, inbound.Data)
+		case "SET_PERMISSIONS":
+			h.handleSetPermissions(room, participant, inbound.Data)
+		case "CHAT_SEND":
+			h.handleChatSend(room, participant, inbound.Data)
+		case "PLAYLIST_ADD":
+			h.handlePlaylistAdd(room, participant, inbound.Data)
+		case "PLAYLIST_REMOVE":
+			h.handlePlaylistRemove(room, participant, inbound.Data)
+		case "PLAYLIST_MOVE":
+			h.handlePlaylistMove(room, participant, inbound.Data)
+		case "PLAYLIST_PLAY_NOW":
+			h.handlePlaylistPlayNow(room, participant, inbound.Data)
+		case "MEDIA_ENDED":
+			h.handleMediaEnded(room, participant, inbound.Data)
+		case "ADMIT":
+			h.handleAdmission(room, participant, inbound.Data, true)
+		case "DENY":
+			h.handleAdmission(room, participant, inbound.Data, false)
+		case "KICK":
+			h.handleModeration(room, participant, inbound.Data, rooms.AuditKick)
+		case "BAN":
+			h.handleModeration(room, participant, inbound.Data, rooms.AuditBan)
+		case "MUTE":
+			h.handleModeration(room, participant, inbound.Data, rooms.AuditMute)
+		case "UNMUTE":
+			h.handleModeration(room, participant, inbound.Data, rooms.AuditUnmute)
+		case "TIME_PING":
+			h.handleTimePing(participant, inbound.Data, receivedAt)
 		default:
 			participant.Send(protocol.Envelope{
 				Kind: "ERROR",
@@ -198,20 +348,140 @@ func (h *Handler) readLoop(ctx context.Context, room *rooms.Room, participant *r
 	}
 }
 
-// handleControlMessage 处理控制消息
-func (h *Handler) handleControlMessage(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
-	// 检查是否为房主
-	if !participant.IsHost {
-		participant.Send(protocol.Envelope{
-			Kind: "ERROR",
-			Data: protocol.ErrorPayload{
-				Code:    "unauthorized",
-				Message: "Only host can control playback",
-			},
-		})
+// handshake 等待客户端的 HELLO 并直接回复 WELCOME，返回协商的功能；超时未收到 HELLO、首条消息不是 HELLO
+// 或版本过低时回复 upgrade_required 并返回 false
+func (h *Handler) handshake(ctx context.Context, room *rooms.Room, participant *rooms.Participant, conn *websocket.Conn, codec protocol.Codec) ([]string, bool) {
+	if h.helloTimeout > 0 {
+		setReadTimeout(conn, h.helloTimeout)
+	}
+	msgType, data, err := conn.ReadMessage()
+	if err != nil {
+		// 旧客户端连接后只等待服务器推送，不会发送任何消息，同样提示升级；对端已断开时写入失败可忽略
+		ilog.EventInfo(ctx, "WebSocket_hello_failed", "room", room.ID(), "user", participant.ID, "error", err.Error())
+		h.rejectClient(conn, codec, "HELLO handshake required before any other message")
+		return nil, false
+	}
+
+	var hello protocol.Hello
+	inbound, err := codec.DecodeInbound(data)
+	if err != nil || (msgType == websocket.BinaryMessage) != codec.Binary() || inbound.Kind != "HELLO" || json.Unmarshal(inbound.Data, &hello) != nil {
+		ilog.EventInfo(ctx, "WebSocket_upgrade_required", "room", room.ID(), "user", participant.ID, "reason", "missing_hello")
+		h.rejectClient(conn, codec, "HELLO handshake required before any other message")
+		return nil, false
+	}
+	version, err := protocol.NegotiateVersion(hello.ProtocolVersion)
+	if err != nil {
+		ilog.EventInfo(ctx, "WebSocket_upgrade_required", "room", room.ID(), "user", participant.ID, "client", hello.Client, "version", hello.ProtocolVersion)
+		h.rejectClient(conn, codec, err.Error())
+		return nil, false
+	}
+
+	welcome := protocol.Welcome{
+		ServerVersion:   h.serverVersion,
+		ProtocolVersion: version,
+		Codec:           codec.Name(),
+		Features:        protocol.NegotiateFeatures(hello.Capabilities),
+		Limits: protocol.Limits{
+			MaxMessageBytes:      h.maxMessageBytes,
+			MaxChatMessageLength: rooms.MaxChatMessageLength,
+			MaxPlaylistItems:     rooms.MaxPlaylistItems,
+			MaxParticipants:      room.StateSnapshot().Settings.MaxParticipants,
+			PingIntervalMs:       h.pingInterval.Milliseconds(),
+			PongWaitMs:           h.pongWait.Milliseconds(),
+		},
+	}
+	if err := h.writeDirect(conn, codec, protocol.Envelope{Kind: "WELCOME", Data: welcome}); err != nil {
+		ilog.EventError(ctx, err, "WebSocket: write welcome failed", "room", room.ID(), "user", participant.ID)
+		return nil, false
+	}
+	ilog.EventInfo(ctx, "WebSocket_welcome", "room", room.ID(), "user", participant.ID, "client", hello.Client, "version", version)
+	return welcome.Features, true
+}
+
+// rejectClient 回复 upgrade_required 错误并以 CloseUpgradeRequired 关闭连接
+func (h *Handler) rejectClient(conn *websocket.Conn, codec protocol.Codec, message string) {
+	_ = h.writeDirect(conn, codec, protocol.Envelope{
+		Kind: "ERROR",
+		Data: protocol.ErrorPayload{
+			Code:               "upgrade_required",
+			Message:            message,
+			MinProtocolVersion: protocol.MinProtocolVersion,
+		},
+	})
+	closeMessage := websocket.FormatCloseMessage(protocol.CloseUpgradeRequired, protocol.CloseReasonUpgradeRequired)
+	_ = conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(h.writeWait))
+}
+
+// writeDirect 绕过发送队列直接写出一条消息，仅用于发送循环启动之前
+func (h *Handler) writeDirect(conn *websocket.Conn, codec protocol.Codec, envelope protocol.Envelope) error {
+	data, err := codec.Encode(envelope)
+	if err != nil {
+		return err
+	}
+	messageType := websocket.TextMessage
+	if codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(h.writeWait))
+	return conn.WriteMessage(messageType, data)
+}
+
+// extendReadDeadline 顺延读超时
+func (h *Handler) extendReadDeadline(conn *websocket.Conn) {
+	if h.pongWait <= 0 {
+		return
+	}
+	setReadTimeout(conn, h.pongWait)
+}
+
+// readTimeouter Hertz 连接提供的按次读取超时
+type readTimeouter interface {
+	SetReadTimeout(t time.Duration) error
+}
+
+// setReadTimeout 设置读超时，d<=0 表示不超时。netpoll 传输不支持 SetReadDeadline，
+// 此时改为限制单次读取的等待时间，对等待下一条消息的场景效果相同
+func setReadTimeout(conn *websocket.Conn, d time.Duration) {
+	var deadline time.Time
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	if err := conn.SetReadDeadline(deadline); err == nil {
+		return
+	}
+	if d < 0 {
+		d = 0
+	}
+	if timeouter, ok := conn.UnderlyingConn().(readTimeouter); ok {
+		_ = timeouter.SetReadTimeout(d)
+	}
+}
+
+// pingLoop 定期发送 ping 直到 stop 关闭；ping 写入失败时释放连接，读循环随之退出并走正常的断线流程
+func (h *Handler) pingLoop(ctx context.Context, participant *rooms.Participant, conn *websocket.Conn, stop <-chan struct{}) {
+	if h.pingInterval <= 0 {
 		return
 	}
+	ticker := time.NewTicker(h.pingInterval)
+	defer ticker.Stop()
 
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// WriteControl 可以与发送循环的写入并发调用
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(h.writeWait)); err != nil {
+				ilog.EventInfo(ctx, "WebSocket_ping_failed", "user", participant.ID, "error", err.Error())
+				participant.Release(conn)
+				return
+			}
+		}
+	}
+}
+
+// handleControlMessage 处理控制消息
+func (h *Handler) handleControlMessage(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
 	// 解析控制消息
 	var control protocol.ControlMessage
 	if err := json.Unmarshal(data, &control); err != nil {
@@ -227,13 +497,7 @@ func (h *Handler) handleControlMessage(room *rooms.Room, participant *rooms.Part
 	// 应用控制命令
 	state, err := room.ApplyControl(participant.ID, control)
 	if err != nil {
-		participant.Send(protocol.Envelope{
-			Kind: "ERROR",
-			Data: protocol.ErrorPayload{
-				Code:    "control_failed",
-				Message: err.Error(),
-			},
-		})
+		h.sendControlError(room, participant, err, "control_failed")
 		return
 	}
 
@@ -244,6 +508,292 @@ func (h *Handler) handleControlMessage(room *rooms.Room, participant *rooms.Part
 	})
 }
 
+// handleCommand 处理播放命令并广播对应事件
+func (h *Handler) handleCommand(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var cmd protocol.PlaybackCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		log.Printf("WebSocket: unmarshal command error: %v", err)
+		return
+	}
+
+	event, err := room.ApplyCommand(participant.ID, cmd)
+	if err != nil {
+		h.sendControlError(room, participant, err, "invalid_command")
+		return
+	}
+
+	room.BroadcastPlayback(event)
+}
+
+// sendControlError 发送控制/命令失败的错误，版本冲突时额外附带最新状态以便客户端在其基础上重试
+func (h *Handler) sendControlError(room *rooms.Room, participant *rooms.Participant, err error, fallback string) {
+	if code := h.sendError(participant, err, fallback); code == "conflict" {
+		participant.Send(protocol.Envelope{
+			Kind: "ROOM_STATE",
+			Data: protocol.RoomStatePayload{Room: room.StateSnapshot()},
+		})
+	}
+}
+
+// sendError 将房间返回的错误映射为错误码发送给客户端，未知错误使用 fallback，返回实际使用的错误码
+func (h *Handler) sendError(participant *rooms.Participant, err error, fallback string) string {
+	payload := protocol.ErrorPayload{
+		Code:    fallback,
+		Message: err.Error(),
+	}
+
+	var permErr *rooms.PermissionError
+	switch {
+	case errors.As(err, &permErr):
+		payload.Code = "missing_" + permErr.Permission + "_permission"
+		payload.Permission = permErr.Permission
+	case errors.Is(err, rooms.ErrUnauthorizedControl):
+		payload.Code = "unauthorized"
+	case errors.Is(err, rooms.ErrInvalidRate):
+		payload.Code = "invalid_rate"
+	case errors.Is(err, rooms.ErrInvalidPosition):
+		payload.Code = "invalid_position"
+	case errors.Is(err, rooms.ErrStaleRevision):
+		payload.Code = "conflict"
+	case errors.Is(err, rooms.ErrParticipantNotFound):
+		payload.Code = "participant_not_found"
+	case errors.Is(err, rooms.ErrInvalidRole):
+		payload.Code = "invalid_role"
+	case errors.Is(err, rooms.ErrInvalidPermission):
+		payload.Code = "invalid_permission"
+	case errors.Is(err, rooms.ErrOwnerRoleLocked):
+		payload.Code = "owner_role_locked"
+	case errors.Is(err, rooms.ErrEmptyChatMessage):
+		payload.Code = "empty_message"
+	case errors.Is(err, rooms.ErrChatMessageTooLong):
+		payload.Code = "message_too_long"
+	case errors.Is(err, rooms.ErrInvalidSource):
+		payload.Code = "invalid_source"
+	case errors.Is(err, rooms.ErrPlaylistItemNotFound):
+		payload.Code = "playlist_item_not_found"
+	case errors.Is(err, rooms.ErrPlaylistFull):
+		payload.Code = "playlist_full"
+	case errors.Is(err, rooms.ErrPlaylistEmpty):
+		payload.Code = "playlist_empty"
+	case errors.Is(err, rooms.ErrInvalidPlaylistIndex):
+		payload.Code = "invalid_playlist_index"
+	case errors.Is(err, rooms.ErrInvalidTitle):
+		payload.Code = "invalid_title"
+	case errors.Is(err, rooms.ErrAwaitingAdmission):
+		payload.Code = "awaiting_admission"
+	case errors.Is(err, rooms.ErrNotPending):
+		payload.Code = "not_pending"
+	case errors.Is(err, rooms.ErrCannotModerate):
+		payload.Code = "cannot_moderate"
+	case errors.Is(err, rooms.ErrMuted):
+		payload.Code = "muted"
+	}
+
+	participant.Send(protocol.Envelope{
+		Kind: "ERROR",
+		Data: payload,
+	})
+	return payload.Code
+}
+
+// handleAdmission 处理等候室审批（ADMIT / DENY），结果由房间通知申请者和其他审批成员
+func (h *Handler) handleAdmission(room *rooms.Room, participant *rooms.Participant, data json.RawMessage, admit bool) {
+	var req protocol.AdmissionDecision
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal admission decision error: %v", err)
+		return
+	}
+
+	var err error
+	if admit {
+		err = room.Admit(participant.ID, req.UserID)
+	} else {
+		err = room.Deny(participant.ID, req.UserID, req.Reason)
+	}
+	if err != nil {
+		h.sendError(participant, err, "admission_failed")
+	}
+}
+
+// handleModeration 处理 KICK / BAN / MUTE / UNMUTE，成功后由房间广播并记录审计
+func (h *Handler) handleModeration(room *rooms.Room, participant *rooms.Participant, data json.RawMessage, action string) {
+	var req protocol.ModerationRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal moderation request error: %v", err)
+		return
+	}
+
+	var err error
+	switch action {
+	case rooms.AuditKick:
+		err = room.Kick(participant.ID, req.UserID, req.Reason)
+	case rooms.AuditBan:
+		err = room.Ban(participant.ID, req.UserID, req.Reason)
+	case rooms.AuditMute:
+		err = room.SetMuted(participant.ID, req.UserID, true, req.Reason)
+	case rooms.AuditUnmute:
+		err = room.SetMuted(participant.ID, req.UserID, false, req.Reason)
+	}
+	if err != nil {
+		h.sendError(participant, err, action+"_failed")
+	}
+}
+
+// handleTransferHost 处理房主移交请求，成功后由房间广播 HOST_CHANGED
+func (h *Handler) handleTransferHost(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.TransferHostRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal transfer host error: %v", err)
+		return
+	}
+
+	if _, err := room.TransferHost(participant.ID, req.UserID); err != nil {
+		h.sendError(participant, err, "transfer_failed")
+	}
+}
+
+// handleGrantRole 处理授予角色请求，成功后由房间广播 ROLE_CHANGED
+func (h *Handler) handleGrantRole(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.GrantRoleRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal grant role error: %v", err)
+		return
+	}
+
+	if _, err := room.GrantRole(participant.ID, req.UserID, req.Role); err != nil {
+		h.sendError(participant, err, "grant_role_failed")
+	}
+}
+
+// handleRevokeRole 处理撤销角色请求
+func (h *Handler) handleRevokeRole(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.RevokeRoleRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal revoke role error: %v", err)
+		return
+	}
+
+	if _, err := room.RevokeRole(participant.ID, req.UserID); err != nil {
+		h.sendError(participant, err, "revoke_role_failed")
+	}
+}
+
+// handleSetPermissions 处理修改权限矩阵请求，成功后由房间广播 PERMISSIONS_CHANGED
+func (h *Handler) handleSetPermissions(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.SetPermissionsRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal set permissions error: %v", err)
+		return
+	}
+
+	if _, err := room.SetPermissions(participant.ID, req.Role, req.Permissions); err != nil {
+		h.sendError(participant, err, "set_permissions_failed")
+	}
+}
+
+// handleChatSend 处理聊天消息，成功后由房间广播 CHAT_MESSAGE
+func (h *Handler) handleChatSend(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.ChatSend
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal chat error: %v", err)
+		return
+	}
+
+	if _, err := room.SendChat(participant.ID, req.Text); err != nil {
+		h.sendError(participant, err, "chat_failed")
+	}
+}
+
+// handlePlaylistAdd 处理添加播放列表条目
+func (h *Handler) handlePlaylistAdd(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.PlaylistAdd
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal playlist add error: %v", err)
+		return
+	}
+
+	if _, err := room.AddToPlaylist(participant.ID, req.VideoURL, req.Title, req.PlayNext); err != nil {
+		h.sendError(participant, err, "playlist_failed")
+	}
+}
+
+// handlePlaylistRemove 处理移除播放列表条目
+func (h *Handler) handlePlaylistRemove(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.PlaylistRemove
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal playlist remove error: %v", err)
+		return
+	}
+
+	if err := room.RemoveFromPlaylist(participant.ID, req.ItemID); err != nil {
+		h.sendError(participant, err, "playlist_failed")
+	}
+}
+
+// handlePlaylistMove 处理调整播放列表顺序
+func (h *Handler) handlePlaylistMove(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.PlaylistMove
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal playlist move error: %v", err)
+		return
+	}
+
+	if err := room.MovePlaylistItem(participant.ID, req.ItemID, req.Index); err != nil {
+		h.sendError(participant, err, "playlist_failed")
+	}
+}
+
+// handlePlaylistPlayNow 处理立即播放播放列表条目
+func (h *Handler) handlePlaylistPlayNow(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.PlaylistPlayNow
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal playlist play now error: %v", err)
+		return
+	}
+
+	if _, err := room.PlayNow(participant.ID, req.ItemID); err != nil {
+		h.sendError(participant, err, "playlist_failed")
+	}
+}
+
+// handleMediaEnded 处理播放结束上报，列表非空时自动切到下一条
+func (h *Handler) handleMediaEnded(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.MediaEnded
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal media ended error: %v", err)
+		return
+	}
+
+	if _, _, err := room.MediaEnded(participant.ID, req.VideoURL); err != nil && !errors.Is(err, rooms.ErrUnauthorizedControl) {
+		// 观众的播放器同样会上报结束，没有权限时静默忽略
+		h.sendError(participant, err, "media_ended_failed")
+	}
+}
+
+// sendSnapshot 向参与者发送房间完整快照：播放状态、最近聊天记录、播放列表与成员列表
+func (h *Handler) sendSnapshot(room *rooms.Room, participant *rooms.Participant) {
+	participant.Send(protocol.Envelope{
+		Kind: "ROOM_STATE",
+		Data: protocol.RoomStatePayload{Room: room.StateSnapshot()},
+	})
+	participant.Send(protocol.Envelope{
+		Kind: "CHAT_HISTORY",
+		Data: protocol.ChatHistory{Messages: room.ChatMessages()},
+	})
+	participant.Send(protocol.Envelope{
+		Kind: "PLAYLIST_STATE",
+		Data: room.PlaylistSnapshot(),
+	})
+	participant.Send(protocol.Envelope{
+		Kind: "ROSTER",
+		Data: room.Roster(),
+	})
+	// 有审批权限的成员同时收到尚未处理的入场申请
+	for _, request := range room.PendingRequests(participant.ID) {
+		participant.Send(protocol.Envelope{Kind: "JOIN_REQUEST", Data: request})
+	}
+}
+
 // handleSyncRequest 处理同步请求
 func (h *Handler) handleSyncRequest(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
 	// 解析同步请求
@@ -253,9 +803,53 @@ func (h *Handler) handleSyncRequest(room *rooms.Room, participant *rooms.Partici
 		return
 	}
 
-	// 发送房间状态
+	// 发送房间状态，客户端上报了进度时附带偏差提示
+	payload := protocol.RoomStatePayload{Room: room.StateSnapshot()}
+	if req.Position != nil {
+		drift := room.DriftAt(*req.Position, time.UnixMilli(payload.Room.ServerTime))
+		payload.Drift = &drift
+	}
 	participant.Send(protocol.Envelope{
 		Kind: "ROOM_STATE",
-		Data: protocol.RoomStatePayload{Room: room.StateSnapshot()},
+		Data: payload,
+	})
+}
+
+// handleResume 处理断线重连后的补发请求
+func (h *Handler) handleResume(room *rooms.Room, participant *rooms.Participant, data json.RawMessage) {
+	var req protocol.ResumeRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("WebSocket: unmarshal resume request error: %v", err)
+		return
+	}
+	if !participant.Negotiated(protocol.FeatureResume) {
+		h.sendError(participant, protocol.ErrFeatureNotNegotiated, "feature_not_negotiated")
+		return
+	}
+
+	events, ok := room.EventsSince(req.LastSeq)
+	if !ok {
+		// 缺失的事件已不在缓冲区内，回退为完整快照
+		h.sendSnapshot(room, participant)
+		return
+	}
+	participant.Replay(events)
+}
+
+// handleTimePing 应答时钟同步请求，receivedAt 为读到该消息的服务器时间
+func (h *Handler) handleTimePing(participant *rooms.Participant, data json.RawMessage, receivedAt time.Time) {
+	var ping protocol.TimePing
+	if err := json.Unmarshal(data, &ping); err != nil {
+		log.Printf("WebSocket: unmarshal time ping error: %v", err)
+		return
+	}
+
+	participant.Send(protocol.Envelope{
+		Kind: "TIME_PONG",
+		Data: protocol.TimePong{
+			ClientSentAt:     ping.ClientSentAt,
+			ServerReceivedAt: receivedAt.UnixMilli(),
+			ServerSentAt:     time.Now().UnixMilli(),
+		},
 	})
 }
@@ -0,0 +1,552 @@
+package hertzws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/hertz-contrib/websocket"
+
+	"wethu/internal/protocol"
+	"wethu/internal/rooms"
+)
+
+// startTestServer 在本地随机端口启动只注册 WebSocket 路由的 Hertz 服务，返回监听地址
+func startTestServer(t *testing.T, manager *rooms.Manager, opts ...HandlerOption) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	h := server.New(server.WithHostPorts(addr), server.WithExitWaitTime(0), server.WithDisablePrintRoute(true))
+	h.NoHijackConnPool = true
+	h.GET("/ws/rooms/:roomId", NewHandler(manager, opts...).HandleWebSocket)
+	go h.Run()
+	t.Cleanup(func() { _ = h.Close() })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testClient 测试用的最小 WebSocket 客户端，只支持未压缩的文本帧
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// testFrame 客户端读到的一条完整消息；关闭帧的 closeCode 为对端给出的关闭码
+type testFrame struct {
+	opcode    int
+	data      []byte
+	closeCode int
+}
+
+// dialTestClient 以 token 连接房间并完成 HTTP 升级，尚未发送 HELLO
+func dialTestClient(t *testing.T, addr, roomID, token string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	target := fmt.Sprintf("/ws/rooms/%s?token=%s", roomID, url.QueryEscape(token))
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\n\r\n", target, addr, base64.StdEncoding.EncodeToString(key))
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatalf("write upgrade request failed: %v", err)
+	}
+
+	r := bufio.NewReader(conn)
+	response, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("read upgrade response failed: %v", err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed with status %d", response.StatusCode)
+	}
+	return &testClient{t: t, conn: conn, r: r}
+}
+
+// send 以带掩码的文本帧发送一条 JSON 信封
+func (c *testClient) send(kind string, data interface{}) {
+	c.t.Helper()
+	payload, err := json.Marshal(map[string]interface{}{"kind": kind, "data": data})
+	if err != nil {
+		c.t.Fatalf("marshal failed: %v", err)
+	}
+	header := []byte{0x80 | websocket.TextMessage}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, 0x80|byte(n))
+	case n <= 0xffff:
+		header = append(header, 0x80|126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 0x80|127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	mask := make([]byte, 4)
+	_, _ = rand.Read(mask)
+	header = append(header, mask...)
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		c.t.Fatalf("write frame failed: %v", err)
+	}
+}
+
+// hello 发送 HELLO
+func (c *testClient) hello(version int, capabilities ...string) {
+	c.send("HELLO", protocol.Hello{ProtocolVersion: version, Client: "test", Capabilities: capabilities})
+}
+
+// read 读取下一条消息，跳过 ping/pong 并拼接分片；连接出错时返回 err
+func (c *testClient) read(timeout time.Duration) (testFrame, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+	var message testFrame
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			return testFrame{}, err
+		}
+		fin, opcode := header[0]&0x80 != 0, int(header[0]&0x0f)
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(c.r, ext); err != nil {
+				return testFrame{}, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(c.r, ext); err != nil {
+				return testFrame{}, err
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return testFrame{}, err
+		}
+
+		switch opcode {
+		case websocket.PingMessage, websocket.PongMessage:
+			continue
+		case websocket.CloseMessage:
+			frame := testFrame{opcode: opcode}
+			if len(payload) >= 2 {
+				frame.closeCode = int(binary.BigEndian.Uint16(payload))
+				frame.data = payload[2:]
+			}
+			return frame, nil
+		case 0:
+			// 续帧
+		default:
+			message.opcode = opcode
+		}
+		message.data = append(message.data, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// testEnvelope 客户端收到的 JSON 信封
+type testEnvelope struct {
+	Kind string          `json:"kind"`
+	Seq  uint64          `json:"seq"`
+	Data json.RawMessage `json:"data"`
+}
+
+// readEnvelope 读取下一条信封；连接关闭或超时则测试失败
+func (c *testClient) readEnvelope(timeout time.Duration) testEnvelope {
+	c.t.Helper()
+	frame, err := c.read(timeout)
+	if err != nil {
+		c.t.Fatalf("read message: %v", err)
+	}
+	if frame.opcode == websocket.CloseMessage {
+		c.t.Fatalf("connection closed with code %d", frame.closeCode)
+	}
+	var envelope testEnvelope
+	if err := json.Unmarshal(frame.data, &envelope); err != nil {
+		c.t.Fatalf("decode message failed: %v", err)
+	}
+	return envelope
+}
+
+// readKind 读取直到收到 kind 类型的消息并返回其 data；连接关闭或超时则测试失败
+func (c *testClient) readKind(kind string) json.RawMessage {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if envelope := c.readEnvelope(time.Until(deadline)); envelope.Kind == kind {
+			return envelope.Data
+		}
+	}
+}
+
+// TestReconnectReplacesConnection 同一参与者重新连接后，旧连接被关闭，之后的消息全部发往新连接
+func TestReconnectReplacesConnection(t *testing.T) {
+	manager := rooms.NewManager()
+	defer manager.Close()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	addr := startTestServer(t, manager)
+
+	first := dialTestClient(t, addr, session.RoomID, session.Token)
+	first.hello(protocol.ProtocolVersion)
+	first.readKind("WELCOME")
+	first.readKind("ROOM_STATE")
+
+	second := dialTestClient(t, addr, session.RoomID, session.Token)
+	second.hello(protocol.ProtocolVersion)
+	second.readKind("WELCOME")
+	// 队列中的消息只经已绑定连接的发送循环发出，收到快照说明旧连接已被替换
+	second.readKind("ROOM_STATE")
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		room.Broadcast(protocol.Envelope{Kind: "TEST_EVENT", Data: i})
+	}
+	for i := 0; i < count; i++ {
+		var got int
+		if err := json.Unmarshal(second.readKind("TEST_EVENT"), &got); err != nil || got != i {
+			t.Fatalf("second connection expected event %d, got %d (%v)", i, got, err)
+		}
+	}
+
+	// 旧连接不再收到任何事件，随后被关闭
+	for {
+		frame, err := first.read(5 * time.Second)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Fatal("replaced connection should be closed")
+			}
+			break
+		}
+		if frame.opcode == websocket.CloseMessage {
+			break
+		}
+		var envelope struct {
+			Kind string `json:"kind"`
+		}
+		if json.Unmarshal(frame.data, &envelope) == nil && envelope.Kind == "TEST_EVENT" {
+			t.Fatal("replaced connection should not receive events")
+		}
+	}
+}
+
+// expectUpgradeRequired 读取 upgrade_required 错误与 CloseUpgradeRequired 关闭帧
+func expectUpgradeRequired(t *testing.T, client *testClient) {
+	t.Helper()
+	var payload protocol.ErrorPayload
+	if err := json.Unmarshal(client.readKind("ERROR"), &payload); err != nil {
+		t.Fatalf("decode error payload failed: %v", err)
+	}
+	if payload.Code != "upgrade_required" || payload.MinProtocolVersion != protocol.MinProtocolVersion {
+		t.Errorf("expected upgrade_required with min version, got %+v", payload)
+	}
+	frame, err := client.read(5 * time.Second)
+	if err != nil {
+		t.Fatalf("expected close frame: %v", err)
+	}
+	if frame.opcode != websocket.CloseMessage || frame.closeCode != protocol.CloseUpgradeRequired {
+		t.Errorf("expected close code %d, got opcode %d code %d", protocol.CloseUpgradeRequired, frame.opcode, frame.closeCode)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	manager := rooms.NewManager()
+	defer manager.Close()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	addr := startTestServer(t, manager, WithHelloTimeout(100*time.Millisecond), WithServerVersion("test"))
+
+	t.Run("welcome", func(t *testing.T) {
+		client := dialTestClient(t, addr, session.RoomID, session.Token)
+		client.hello(protocol.ProtocolVersion+1, protocol.FeatureChat, "unknown")
+		var welcome protocol.Welcome
+		if err := json.Unmarshal(client.readKind("WELCOME"), &welcome); err != nil {
+			t.Fatalf("decode welcome failed: %v", err)
+		}
+		if welcome.ProtocolVersion != protocol.ProtocolVersion || welcome.ServerVersion != "test" || welcome.Codec != protocol.SubprotocolJSON {
+			t.Errorf("unexpected welcome: %+v", welcome)
+		}
+		if len(welcome.Features) != 1 || welcome.Features[0] != protocol.FeatureChat {
+			t.Errorf("expected only the chat feature, got %v", welcome.Features)
+		}
+		client.readKind("ROOM_STATE")
+	})
+
+	t.Run("missing hello", func(t *testing.T) {
+		client := dialTestClient(t, addr, session.RoomID, session.Token)
+		client.send("SYNC_REQUEST", map[string]interface{}{})
+		expectUpgradeRequired(t, client)
+	})
+
+	t.Run("old version", func(t *testing.T) {
+		client := dialTestClient(t, addr, session.RoomID, session.Token)
+		client.hello(protocol.MinProtocolVersion - 1)
+		expectUpgradeRequired(t, client)
+	})
+
+	t.Run("hello timeout", func(t *testing.T) {
+		client := dialTestClient(t, addr, session.RoomID, session.Token)
+		expectUpgradeRequired(t, client)
+	})
+}
+
+// TestFeatureGating 未协商的功能对应的事件不会发给该连接
+func TestFeatureGating(t *testing.T) {
+	manager := rooms.NewManager()
+	defer manager.Close()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	addr := startTestServer(t, manager)
+
+	client := dialTestClient(t, addr, session.RoomID, session.Token)
+	client.hello(protocol.ProtocolVersion, protocol.FeatureChat)
+	client.readKind("WELCOME")
+	client.readKind("ROSTER")
+
+	if _, err := room.AddToPlaylist(session.UserID, "https://example.com/ep1", "", false); err != nil {
+		t.Fatalf("AddToPlaylist failed: %v", err)
+	}
+	if _, err := room.SendChat(session.UserID, "hello"); err != nil {
+		t.Fatalf("SendChat failed: %v", err)
+	}
+
+	// 快照与之后的事件中都不应出现 PLAYLIST_STATE，聊天消息照常送达
+	seen := map[string]bool{}
+	deadline := time.Now().Add(5 * time.Second)
+	for !seen["CHAT_MESSAGE"] {
+		frame, err := client.read(time.Until(deadline))
+		if err != nil {
+			t.Fatalf("waiting for CHAT_MESSAGE: %v", err)
+		}
+		var envelope struct {
+			Kind string `json:"kind"`
+		}
+		if err := json.Unmarshal(frame.data, &envelope); err != nil {
+			t.Fatalf("decode message failed: %v", err)
+		}
+		seen[envelope.Kind] = true
+	}
+	if seen["PLAYLIST_STATE"] {
+		t.Error("PLAYLIST_STATE should not be sent without the playlist feature")
+	}
+
+	// 未协商 time_sync 时 TIME_PING 没有应答，未协商 resume 时 RESUME 被拒绝；按顺序处理，收到错误时应答已经发出
+	client.send("TIME_PING", protocol.TimePing{ClientSentAt: time.Now().UnixMilli()})
+	client.send("RESUME", protocol.ResumeRequest{LastSeq: 0})
+	for {
+		envelope := client.readEnvelope(time.Until(deadline))
+		if envelope.Kind == "TIME_PONG" {
+			t.Fatal("TIME_PONG should not be sent without the time_sync feature")
+		}
+		if envelope.Kind != "ERROR" {
+			continue
+		}
+		var payload protocol.ErrorPayload
+		if err := json.Unmarshal(envelope.Data, &payload); err != nil {
+			t.Fatalf("decode error payload failed: %v", err)
+		}
+		if payload.Code != "feature_not_negotiated" {
+			t.Errorf("expected feature_not_negotiated for RESUME, got %+v", payload)
+		}
+		break
+	}
+}
+
+// TestPongTimeout 不回应 ping 的客户端在 pongWait 后被断开，参与者进入断线状态
+func TestPongTimeout(t *testing.T) {
+	manager := rooms.NewManager()
+	defer manager.Close()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	_, participant, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	const pongWait = 300 * time.Millisecond
+	addr := startTestServer(t, manager, WithPongWait(pongWait), WithPingInterval(100*time.Millisecond))
+
+	// 测试客户端不会自动回复 pong，握手后也不再发送任何消息
+	client := dialTestClient(t, addr, session.RoomID, session.Token)
+	client.hello(protocol.ProtocolVersion)
+	client.readKind("WELCOME")
+	client.readKind("ROOM_STATE")
+	if status := participant.Status(); status != protocol.ParticipantConnected {
+		t.Fatalf("expected connected after handshake, got %s", status)
+	}
+	start := time.Now()
+
+	for {
+		frame, err := client.read(5 * time.Second)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Fatal("silent connection should be closed after pongWait")
+			}
+			break
+		}
+		if frame.opcode == websocket.CloseMessage {
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed < pongWait/2 {
+		t.Errorf("connection closed after %v, before pongWait %v", elapsed, pongWait)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for participant.Status() != protocol.ParticipantDisconnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected disconnected after pong timeout, got %s", participant.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestCommandFallback 未协商 commands 的连接收到与 PLAYBACK_EVENT 同序号的 ROOM_STATE
+func TestCommandFallback(t *testing.T) {
+	manager := rooms.NewManager()
+	defer manager.Close()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	viewerSession, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	addr := startTestServer(t, manager)
+
+	host := dialTestClient(t, addr, session.RoomID, session.Token)
+	host.hello(protocol.ProtocolVersion, protocol.FeatureCommands)
+	host.readKind("WELCOME")
+	host.readKind("ROSTER")
+
+	viewer := dialTestClient(t, addr, viewerSession.RoomID, viewerSession.Token)
+	viewer.hello(protocol.ProtocolVersion)
+	viewer.readKind("WELCOME")
+	viewer.readKind("ROSTER")
+
+	position := 42.0
+	host.send("COMMAND", protocol.PlaybackCommand{Type: protocol.CommandSeek, Position: &position})
+	var event protocol.PlaybackEvent
+	var eventSeq uint64
+	deadline := time.Now().Add(5 * time.Second)
+	for eventSeq == 0 {
+		envelope := host.readEnvelope(time.Until(deadline))
+		if envelope.Kind != "PLAYBACK_EVENT" {
+			continue
+		}
+		if err := json.Unmarshal(envelope.Data, &event); err != nil {
+			t.Fatalf("decode playback event failed: %v", err)
+		}
+		eventSeq = envelope.Seq
+	}
+	if event.Command.Type != protocol.CommandSeek || event.State.Position != position {
+		t.Errorf("unexpected playback event %+v", event)
+	}
+
+	for {
+		envelope := viewer.readEnvelope(time.Until(deadline))
+		if envelope.Kind == "PLAYBACK_EVENT" {
+			t.Fatal("PLAYBACK_EVENT should not be sent without the commands feature")
+		}
+		if envelope.Kind != "ROOM_STATE" || envelope.Seq != eventSeq {
+			continue
+		}
+		var payload protocol.RoomStatePayload
+		if err := json.Unmarshal(envelope.Data, &payload); err != nil {
+			t.Fatalf("decode room state failed: %v", err)
+		}
+		if payload.Room.Position != position || payload.Room.Revision != event.State.Revision {
+			t.Errorf("viewer state %+v does not match the command", payload.Room)
+		}
+		break
+	}
+}
+
+// TestTimePing TIME_PONG 原样带回客户端时间，服务器时间落在发送与收到应答之间
+func TestTimePing(t *testing.T) {
+	manager := rooms.NewManager()
+	defer manager.Close()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	addr := startTestServer(t, manager)
+
+	client := dialTestClient(t, addr, session.RoomID, session.Token)
+	client.hello(protocol.ProtocolVersion, protocol.FeatureTimeSync)
+	client.readKind("WELCOME")
+	client.readKind("ROSTER")
+
+	// 客户端时间故意与服务器时间相差很远，服务器只负责原样带回
+	const clientSentAt = 123456789
+	sentAt := time.Now().UnixMilli()
+	client.send("TIME_PING", protocol.TimePing{ClientSentAt: clientSentAt})
+	data := client.readKind("TIME_PONG")
+	receivedAt := time.Now().UnixMilli()
+
+	var pong protocol.TimePong
+	if err := json.Unmarshal(data, &pong); err != nil {
+		t.Fatalf("decode time pong failed: %v", err)
+	}
+	if pong.ClientSentAt != clientSentAt {
+		t.Errorf("ClientSentAt = %d, want %d", pong.ClientSentAt, clientSentAt)
+	}
+	if pong.ServerReceivedAt < sentAt || pong.ServerReceivedAt > pong.ServerSentAt || pong.ServerSentAt > receivedAt {
+		t.Errorf("server times %d..%d should fall within %d..%d", pong.ServerReceivedAt, pong.ServerSentAt, sentAt, receivedAt)
+	}
+}
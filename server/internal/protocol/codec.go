@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// 线上编码对应的 WebSocket 子协议，未协商子协议的连接使用 JSON
+const (
+	SubprotocolJSON    = "wethu.v1.json"
+	SubprotocolMsgpack = "wethu.v1.msgpack"
+)
+
+// Codec 连接使用的线上编码，同一房间内的连接可以使用不同的编码
+type Codec interface {
+	// Name 编码对应的子协议名
+	Name() string
+	// Binary 为 true 时使用二进制帧发送，否则使用文本帧
+	Binary() bool
+	// Encode 序列化出站信封
+	Encode(envelope Envelope) ([]byte, error)
+	// WriteBatch 把多条已序列化的信封作为一个数组写入 w，用于协商了 FeatureBatch 的连接
+	WriteBatch(w io.Writer, encoded [][]byte) error
+	// DecodeInbound 解析入站信封，Data 统一转换为 JSON，各消息处理函数无需关心连接的编码
+	DecodeInbound(data []byte) (InboundEnvelope, error)
+}
+
+var (
+	// JSONCodec JSON 文本帧编码
+	JSONCodec Codec = jsonCodec{}
+	// MsgpackCodec MessagePack 二进制帧编码，字段名与 JSON 相同
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+// Subprotocols 服务器支持的子协议，按优先顺序排列
+var Subprotocols = []string{SubprotocolMsgpack, SubprotocolJSON}
+
+// CodecFor 返回子协议对应的编码，未协商或不认识的子协议使用 JSON
+func CodecFor(subprotocol string) Codec {
+	switch subprotocol {
+	case SubprotocolMsgpack:
+		return MsgpackCodec
+	default:
+		return JSONCodec
+	}
+}
+
+type jsonCodec struct{}
+
+// JSON 信封数组的分隔符，WriteBatch 每次写出都复用
+var (
+	batchOpen  = []byte{'['}
+	batchSep   = []byte{','}
+	batchClose = []byte{']'}
+)
+
+func (jsonCodec) Name() string { return SubprotocolJSON }
+
+func (jsonCodec) Binary() bool { return false }
+
+func (jsonCodec) Encode(envelope Envelope) ([]byte, error) {
+	return json.Marshal(envelope)
+}
+
+func (jsonCodec) WriteBatch(w io.Writer, encoded [][]byte) error {
+	if _, err := w.Write(batchOpen); err != nil {
+		return err
+	}
+	for i, data := range encoded {
+		if i > 0 {
+			if _, err := w.Write(batchSep); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(batchClose)
+	return err
+}
+
+func (jsonCodec) DecodeInbound(data []byte) (InboundEnvelope, error) {
+	var inbound InboundEnvelope
+	err := json.Unmarshal(data, &inbound)
+	return inbound, err
+}
+
+type msgpackCodec struct{}
+
+// msgpackInbound 入站 MessagePack 信封，Data 先解析为通用值再转换为 JSON
+type msgpackInbound struct {
+	Kind string      `msgpack:"kind"`
+	Data interface{} `msgpack:"data"`
+}
+
+func (msgpackCodec) Name() string { return SubprotocolMsgpack }
+
+func (msgpackCodec) Binary() bool { return true }
+
+func (msgpackCodec) Encode(envelope Envelope) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	enc.Reset(&buf)
+	// 沿用 json 标签，两种编码的字段名保持一致
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(envelope); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) WriteBatch(w io.Writer, encoded [][]byte) error {
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	enc.Reset(w)
+	// 数组头之后直接拼接各条消息的编码结果
+	if err := enc.EncodeArrayLen(len(encoded)); err != nil {
+		return err
+	}
+	for _, data := range encoded {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (msgpackCodec) DecodeInbound(data []byte) (InboundEnvelope, error) {
+	var raw msgpackInbound
+	if err := msgpack.Unmarshal(data, &raw); err != nil {
+		return InboundEnvelope{}, err
+	}
+	inbound := InboundEnvelope{Kind: raw.Kind}
+	if raw.Data != nil {
+		payload, err := json.Marshal(raw.Data)
+		if err != nil {
+			return InboundEnvelope{}, err
+		}
+		inbound.Data = payload
+	}
+	return inbound, nil
+}
@@ -0,0 +1,120 @@
+package protocol
+
+import "errors"
+
+// 协议版本：ProtocolVersion 为服务器实现的版本，低于 MinProtocolVersion 的客户端需要升级
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+var (
+	// ErrUpgradeRequired 客户端协议版本过低或没有以 HELLO 开始握手
+	ErrUpgradeRequired = errors.New("client protocol version is no longer supported")
+	// ErrFeatureNotNegotiated 请求使用了握手时没有协商的功能
+	ErrFeatureNotNegotiated = errors.New("feature was not negotiated in HELLO")
+)
+
+// 可协商的功能，WELCOME 中只列出客户端声明支持且服务器提供的功能；
+// 聊天、播放列表、管理、等候室、播放命令与校时的推送事件只发给协商了对应功能的连接，见 FeatureForKind；
+// 未协商 resume 的连接发送 RESUME 会收到 feature_not_negotiated 错误；
+// 协商了 FeatureBatch 的连接会收到合并帧：同一次写出的多条消息编码为一个信封数组，单条消息仍是单个信封
+const (
+	FeatureCommands    = "commands"
+	FeatureResume      = "resume"
+	FeatureTimeSync    = "time_sync"
+	FeatureChat        = "chat"
+	FeaturePlaylist    = "playlist"
+	FeatureWaitingRoom = "waiting_room"
+	FeatureModeration  = "moderation"
+	FeatureBatch       = "batch"
+)
+
+// ServerFeatures 服务器提供的全部功能
+var ServerFeatures = []string{
+	FeatureCommands,
+	FeatureResume,
+	FeatureTimeSync,
+	FeatureChat,
+	FeaturePlaylist,
+	FeatureWaitingRoom,
+	FeatureModeration,
+	FeatureBatch,
+}
+
+// Hello 客户端建立连接后发送的第一条消息（HELLO）
+type Hello struct {
+	ProtocolVersion int `json:"protocolVersion"`
+	// Client 客户端名称及版本，仅用于日志
+	Client       string   `json:"client,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Welcome 握手成功后服务器的回复（WELCOME），之后才会收到房间快照与事件
+type Welcome struct {
+	ServerVersion string `json:"serverVersion"`
+	// ProtocolVersion 双方协商后使用的协议版本
+	ProtocolVersion int `json:"protocolVersion"`
+	// Codec 连接使用的编码（子协议名）
+	Codec    string   `json:"codec"`
+	Features []string `json:"features"`
+	Limits   Limits   `json:"limits"`
+}
+
+// Limits 服务器对连接与房间的限制
+type Limits struct {
+	// MaxMessageBytes 单条入站消息的最大字节数，超过时连接被断开
+	MaxMessageBytes      int64 `json:"maxMessageBytes"`
+	MaxChatMessageLength int   `json:"maxChatMessageLength"`
+	MaxPlaylistItems     int   `json:"maxPlaylistItems"`
+	// MaxParticipants 房间成员数上限，0 表示不限
+	MaxParticipants int `json:"maxParticipants"`
+	// PingIntervalMs 服务器心跳间隔，PongWaitMs 超过该时间没有任何消息（含 pong）即断开；0 表示未启用
+	PingIntervalMs int64 `json:"pingIntervalMs"`
+	PongWaitMs     int64 `json:"pongWaitMs"`
+}
+
+// NegotiateVersion 返回与客户端共同使用的协议版本，客户端版本过低时返回 ErrUpgradeRequired
+func NegotiateVersion(client int) (int, error) {
+	if client < MinProtocolVersion {
+		return 0, ErrUpgradeRequired
+	}
+	if client > ProtocolVersion {
+		// 较新的客户端按服务器版本降级
+		return ProtocolVersion, nil
+	}
+	return client, nil
+}
+
+// NegotiateFeatures 返回客户端声明支持且服务器提供的功能，按 ServerFeatures 的顺序排列
+func NegotiateFeatures(capabilities []string) []string {
+	requested := make(map[string]bool, len(capabilities))
+	for _, capability := range capabilities {
+		requested[capability] = true
+	}
+	features := make([]string, 0, len(ServerFeatures))
+	for _, feature := range ServerFeatures {
+		if requested[feature] {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// featureKinds 依赖协商功能的推送事件。KICKED、ADMISSION_* 等关系到连接本身的事件总是发送；
+// 未协商 commands 的连接以 ROOM_STATE 代替 PLAYBACK_EVENT
+var featureKinds = map[string]string{
+	"PLAYBACK_EVENT":        FeatureCommands,
+	"TIME_PONG":             FeatureTimeSync,
+	"CHAT_MESSAGE":          FeatureChat,
+	"CHAT_HISTORY":          FeatureChat,
+	"PLAYLIST_STATE":        FeaturePlaylist,
+	"PARTICIPANT_MUTED":     FeatureModeration,
+	"JOIN_REQUEST":          FeatureWaitingRoom,
+	"JOIN_REQUEST_RESOLVED": FeatureWaitingRoom,
+}
+
+// FeatureForKind 返回推送事件所属的可协商功能，不依赖协商的事件返回空字符串
+func FeatureForKind(kind string) string {
+	return featureKinds[kind]
+}
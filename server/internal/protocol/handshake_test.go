@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		client  int
+		want    int
+		wantErr error
+	}{
+		{client: ProtocolVersion, want: ProtocolVersion},
+		{client: ProtocolVersion + 1, want: ProtocolVersion},
+		{client: MinProtocolVersion - 1, wantErr: ErrUpgradeRequired},
+		{client: -1, wantErr: ErrUpgradeRequired},
+	}
+	for _, tt := range tests {
+		got, err := NegotiateVersion(tt.client)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("NegotiateVersion(%d) = %d, %v; want %d, %v", tt.client, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNegotiateFeatures(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities []string
+		want         []string
+	}{
+		{name: "none", capabilities: nil, want: []string{}},
+		{name: "unknown dropped", capabilities: []string{"video_calls", FeatureChat}, want: []string{FeatureChat}},
+		{name: "server order", capabilities: []string{FeatureModeration, FeatureChat, FeatureCommands}, want: []string{FeatureCommands, FeatureChat, FeatureModeration}},
+		{name: "duplicates", capabilities: []string{FeaturePlaylist, FeaturePlaylist}, want: []string{FeaturePlaylist}},
+		{name: "all", capabilities: ServerFeatures, want: ServerFeatures},
+	}
+	for _, tt := range tests {
+		if got := NegotiateFeatures(tt.capabilities); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: NegotiateFeatures(%v) = %v, want %v", tt.name, tt.capabilities, got, tt.want)
+		}
+	}
+}
+
+func TestFeatureForKind(t *testing.T) {
+	if got := FeatureForKind("CHAT_MESSAGE"); got != FeatureChat {
+		t.Errorf("CHAT_MESSAGE should require %s, got %q", FeatureChat, got)
+	}
+	if got := FeatureForKind("PLAYLIST_STATE"); got != FeaturePlaylist {
+		t.Errorf("PLAYLIST_STATE should require %s, got %q", FeaturePlaylist, got)
+	}
+	if got := FeatureForKind("PLAYBACK_EVENT"); got != FeatureCommands {
+		t.Errorf("PLAYBACK_EVENT should require %s, got %q", FeatureCommands, got)
+	}
+	if got := FeatureForKind("TIME_PONG"); got != FeatureTimeSync {
+		t.Errorf("TIME_PONG should require %s, got %q", FeatureTimeSync, got)
+	}
+	// 关系到连接本身的事件不受协商影响
+	for _, kind := range []string{"ROOM_STATE", "KICKED", "ROOM_CLOSED", "ERROR"} {
+		if got := FeatureForKind(kind); got != "" {
+			t.Errorf("%s should always be delivered, got %q", kind, got)
+		}
+	}
+}
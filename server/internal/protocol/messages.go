@@ -12,8 +12,53 @@ type RoomState struct {
 	Position  float64   `json:"position"`
 	OwnerID   string    `json:"ownerId"`
 	UpdatedAt time.Time `json:"updatedAt"`
+	// Revision 播放状态版本号，每次控制生效后递增
+	Revision uint64 `json:"revision"`
+	// PlaybackRate 播放速率，推算进度时按 elapsed*PlaybackRate 前进
+	PlaybackRate float64      `json:"playbackRate"`
+	Settings     RoomSettings `json:"settings"`
+	// Permissions 各角色拥有的权限
+	Permissions map[string][]string `json:"permissions"`
+	// Seq 快照时房间最近一次广播事件的序号
+	Seq uint64 `json:"seq"`
+	// ServerTime 生成快照时的服务器时间（Unix 毫秒），Position 即该时刻推算出的进度，
+	// 客户端以此为锚点结合时钟偏移继续推算
+	ServerTime int64 `json:"serverTime"`
+	// HasPassword 加入房间是否需要密码
+	HasPassword bool `json:"hasPassword"`
 }
 
+// 参与者角色
+const (
+	RoleOwner     = "owner"
+	RoleCoHost    = "cohost"
+	RoleViewer    = "viewer"
+	RoleSpectator = "spectator"
+)
+
+// 权限
+const (
+	PermissionPlay           = "play"
+	PermissionSeek           = "seek"
+	PermissionChangeSource   = "change_source"
+	PermissionManagePlaylist = "manage_playlist"
+	PermissionChat           = "chat"
+	PermissionKick           = "kick"
+	PermissionManageRoles    = "manage_roles"
+	PermissionInvite         = "invite"
+)
+
+// RoomSettings 创建房间时指定的房间设置
+type RoomSettings struct {
+	// AutoPauseOnHostLeave 房主断开连接时自动暂停播放
+	AutoPauseOnHostLeave bool `json:"autoPauseOnHostLeave"`
+	// WaitingRoom 新成员需经房主批准才能入场
+	WaitingRoom bool `json:"waitingRoom"`
+	// MaxParticipants 房间成员数上限，0 表示不限
+	MaxParticipants int `json:"maxParticipants"`
+}
+
+// ControlMessage 旧版控制消息，新客户端应使用 PlaybackCommand
 type ControlMessage struct {
 	Type    string         `json:"type"`
 	RoomID  string         `json:"roomId"`
@@ -25,26 +70,333 @@ type ControlPayload struct {
 	Position float64   `json:"position"`
 	VideoURL *string   `json:"videoUrl,omitempty"`
 	Playing  *bool     `json:"isPlaying,omitempty"`
+	Rate     *float64  `json:"playbackRate,omitempty"`
 	IssuedAt time.Time `json:"issuedAt"`
+	// BaseRevision 客户端发出控制时所基于的状态版本，与当前版本不一致时被拒绝
+	BaseRevision *uint64 `json:"baseRevision,omitempty"`
+}
+
+// 播放命令类型
+const (
+	CommandPlay         = "PLAY"
+	CommandPause        = "PAUSE"
+	CommandSeek         = "SEEK"
+	CommandSetRate      = "SET_RATE"
+	CommandChangeSource = "CHANGE_SOURCE"
+	CommandStop         = "STOP"
+)
+
+// PlaybackCommand 客户端发送的播放命令（COMMAND），不同类型使用不同字段
+type PlaybackCommand struct {
+	Type     string   `json:"type"`
+	Position *float64 `json:"position,omitempty"`
+	Rate     float64  `json:"rate,omitempty"`
+	VideoURL string   `json:"videoUrl,omitempty"`
+	// BaseRevision 同 ControlPayload.BaseRevision
+	BaseRevision *uint64 `json:"baseRevision,omitempty"`
+}
+
+// PlaybackEvent 命令生效后广播的事件（PLAYBACK_EVENT），Command 中的字段已补全为实际生效的值
+type PlaybackEvent struct {
+	Command   PlaybackCommand `json:"command"`
+	ActorID   string          `json:"actorId"`
+	ActorName string          `json:"actorName"`
+	State     RoomState       `json:"state"`
 }
 
 type RoomStatePayload struct {
 	Room RoomState `json:"room"`
+	// Drift 回复 SYNC_REQUEST 时给出的偏差提示（秒），正数表示客户端超前
+	Drift *float64 `json:"drift,omitempty"`
 }
 
 type SyncRequest struct {
 	RoomID   string `json:"roomId"`
 	SenderID string `json:"senderId"`
+	// Position 客户端当前播放进度，可选，提供时服务器会返回偏差提示
+	Position *float64 `json:"position,omitempty"`
+}
+
+// ResumeRequest 断线重连后请求补发 LastSeq 之后的事件
+type ResumeRequest struct {
+	LastSeq uint64 `json:"lastSeq"`
+}
+
+// TimePing 客户端时钟同步请求，时间均为 Unix 毫秒
+type TimePing struct {
+	ClientSentAt int64 `json:"clientSentAt"`
+}
+
+// TimePong 时钟同步应答，客户端收到后可计算：
+// RTT = (now - ClientSentAt) - (ServerSentAt - ServerReceivedAt)
+// offset = ((ServerReceivedAt - ClientSentAt) + (ServerSentAt - now)) / 2
+type TimePong struct {
+	ClientSentAt     int64 `json:"clientSentAt"`
+	ServerReceivedAt int64 `json:"serverReceivedAt"`
+	ServerSentAt     int64 `json:"serverSentAt"`
+}
+
+// TransferHostRequest 房主主动移交房主身份
+type TransferHostRequest struct {
+	UserID string `json:"userId"`
+}
+
+// HostChanged 房主变更事件（HOST_CHANGED）
+type HostChanged struct {
+	PreviousHostID string `json:"previousHostId"`
+	HostID         string `json:"hostId"`
+	HostName       string `json:"hostName"`
+	// Reason 变更原因：transfer 主动移交，host_absent 房主缺席自动移交
+	Reason string `json:"reason"`
+}
+
+// GrantRoleRequest 授予角色（GRANT_ROLE）
+type GrantRoleRequest struct {
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+}
+
+// RevokeRoleRequest 撤销角色（REVOKE_ROLE），目标恢复为 viewer
+type RevokeRoleRequest struct {
+	UserID string `json:"userId"`
+}
+
+// RoleChanged 角色变更事件（ROLE_CHANGED）
+type RoleChanged struct {
+	UserID    string `json:"userId"`
+	Role      string `json:"role"`
+	ChangedBy string `json:"changedBy"`
+}
+
+// SetPermissionsRequest 修改某个角色的权限（SET_PERMISSIONS）
+type SetPermissionsRequest struct {
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+// PermissionsChanged 权限矩阵变更事件（PERMISSIONS_CHANGED）
+type PermissionsChanged struct {
+	Permissions map[string][]string `json:"permissions"`
+}
+
+// ChatSend 客户端发送聊天消息（CHAT_SEND）
+type ChatSend struct {
+	Text string `json:"text"`
+}
+
+// ChatMessage 聊天消息（CHAT_MESSAGE），SentAt 为服务器时间
+type ChatMessage struct {
+	ID          string    `json:"id"`
+	SenderID    string    `json:"senderId"`
+	DisplayName string    `json:"displayName"`
+	Text        string    `json:"text"`
+	SentAt      time.Time `json:"sentAt"`
+}
+
+// ChatHistory 最近的聊天记录（CHAT_HISTORY）
+type ChatHistory struct {
+	Messages []ChatMessage `json:"messages"`
+}
+
+// PlaylistItem 播放列表条目
+type PlaylistItem struct {
+	ID       string    `json:"id"`
+	VideoURL string    `json:"videoUrl"`
+	Title    string    `json:"title,omitempty"`
+	AddedBy  string    `json:"addedBy"`
+	AddedAt  time.Time `json:"addedAt"`
+}
+
+// PlaylistState 待播放列表（PLAYLIST_STATE），不包含正在播放的片源
+type PlaylistState struct {
+	Items []PlaylistItem `json:"items"`
+}
+
+// PlaylistAdd 添加条目（PLAYLIST_ADD），PlayNext 为 true 时插到队首
+type PlaylistAdd struct {
+	VideoURL string `json:"videoUrl"`
+	Title    string `json:"title,omitempty"`
+	PlayNext bool   `json:"playNext,omitempty"`
+}
+
+// PlaylistRemove 移除条目（PLAYLIST_REMOVE）
+type PlaylistRemove struct {
+	ItemID string `json:"itemId"`
+}
+
+// PlaylistMove 调整条目顺序（PLAYLIST_MOVE），Index 从 0 开始
+type PlaylistMove struct {
+	ItemID string `json:"itemId"`
+	Index  int    `json:"index"`
+}
+
+// PlaylistPlayNow 立即切换到条目（PLAYLIST_PLAY_NOW），ItemID 为空时播放队首；
+// 排到下一个播放请用 PlaylistAdd 的 PlayNext
+type PlaylistPlayNow struct {
+	ItemID string `json:"itemId,omitempty"`
+}
+
+// MediaEnded 客户端上报当前片源播放结束（MEDIA_ENDED）
+type MediaEnded struct {
+	VideoURL string `json:"videoUrl"`
+}
+
+// Invite 邀请链接，凭邀请码加入时无需房间密码；MaxUses 为 0 表示不限次数
+type Invite struct {
+	Code      string    `json:"code"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	MaxUses   int       `json:"maxUses"`
+	Uses      int       `json:"uses"`
+}
+
+// JoinRequest 等候室中的入场申请（JOIN_REQUEST），发给有权审批的成员
+type JoinRequest struct {
+	UserID      string    `json:"userId"`
+	DisplayName string    `json:"displayName"`
+	RequestedAt time.Time `json:"requestedAt"`
+}
+
+// AdmissionDecision 审批入场申请（ADMIT / DENY），Reason 仅用于 DENY
+type AdmissionDecision struct {
+	UserID string `json:"userId"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AdmissionPending 连接建立时告知申请者正在等待审批（ADMISSION_PENDING）
+type AdmissionPending struct {
+	RoomID string `json:"roomId"`
+}
+
+// AdmissionResult 告知申请者审批结果（ADMISSION_RESULT），被拒绝后服务器会断开连接
+type AdmissionResult struct {
+	Admitted bool   `json:"admitted"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// JoinRequestResolved 入场申请已被处理（JOIN_REQUEST_RESOLVED），发给有权审批的成员
+type JoinRequestResolved struct {
+	UserID    string `json:"userId"`
+	Admitted  bool   `json:"admitted"`
+	DecidedBy string `json:"decidedBy,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// ModerationRequest 管理成员（KICK / BAN / MUTE / UNMUTE）
+type ModerationRequest struct {
+	UserID string `json:"userId"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Kicked 告知被移出的成员（KICKED），之后服务器会断开连接
+type Kicked struct {
+	Reason string `json:"reason,omitempty"`
+	By     string `json:"by"`
+	Banned bool   `json:"banned"`
+}
+
+// ParticipantMuted 成员禁言状态变更事件（PARTICIPANT_MUTED）
+type ParticipantMuted struct {
+	UserID string `json:"userId"`
+	Muted  bool   `json:"muted"`
+	By     string `json:"by"`
+}
+
+// AuditEntry 房间审计记录
+type AuditEntry struct {
+	Action     string    `json:"action"`
+	ActorID    string    `json:"actorId"`
+	ActorName  string    `json:"actorName"`
+	TargetID   string    `json:"targetId"`
+	TargetName string    `json:"targetName"`
+	Reason     string    `json:"reason,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// AuditTrail 房间审计记录列表
+type AuditTrail struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// 参与者连接状态；PARTICIPANT_LEFT 中为 disconnected 表示断线后仍在重连宽限期内，
+// 为 gone 表示参与者已被移出房间（主动离开、被踢出或宽限期过后仍未重连）
+const (
+	ParticipantConnected    = "connected"
+	ParticipantDisconnected = "disconnected"
+	ParticipantGone         = "gone"
+)
+
+// ParticipantInfo 成员信息（PARTICIPANT_JOINED / PARTICIPANT_LEFT）
+type ParticipantInfo struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Status string `json:"status"`
+	// ConnectedSince 最近一次上线时间
+	ConnectedSince time.Time `json:"connectedSince"`
+	Muted          bool      `json:"muted,omitempty"`
+	// Delivery 出站队列统计，仅在成员列表中提供
+	Delivery *DeliveryStats `json:"delivery,omitempty"`
+}
+
+// DeliveryStats 参与者出站队列的投递统计
+type DeliveryStats struct {
+	// Queued 当前积压的消息数
+	Queued int `json:"queued"`
+	// Coalesced 被更新的同类消息取代的消息数
+	Coalesced uint64 `json:"coalesced"`
+	// Dropped 因积压被丢弃的消息数
+	Dropped uint64 `json:"dropped"`
+	// SlowConsumerDisconnects 因积压超过上限被断开的次数
+	SlowConsumerDisconnects uint64 `json:"slowConsumerDisconnects"`
+}
+
+// Roster 房间成员列表（ROSTER）
+type Roster struct {
+	Participants []ParticipantInfo `json:"participants"`
+}
+
+// 房间关闭原因
+const (
+	RoomClosedIdle     = "idle_timeout"
+	RoomClosedLifetime = "lifetime_exceeded"
+	RoomClosedEmpty    = "empty_timeout"
+)
+
+// WebSocket 关闭码，4000-4999 为应用自定义
+const (
+	// CloseSlowConsumer 客户端消费过慢，出站队列积压超过上限
+	CloseSlowConsumer = 4008
+	// CloseUpgradeRequired 客户端协议版本不兼容或没有完成 HELLO 握手
+	CloseUpgradeRequired = 4009
+)
+
+// 与关闭码一起发送的关闭原因
+const (
+	CloseReasonSlowConsumer    = "slow_consumer"
+	CloseReasonUpgradeRequired = "upgrade_required"
+)
+
+// RoomClosed 房间被关闭（ROOM_CLOSED），之后服务器会断开连接
+type RoomClosed struct {
+	Reason string `json:"reason"`
 }
 
 type ErrorPayload struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
+	// Permission 因缺少权限失败时，缺少的权限名
+	Permission string `json:"permission,omitempty"`
+	// MinProtocolVersion 回复 upgrade_required 时，服务器要求的最低协议版本
+	MinProtocolVersion int `json:"minProtocolVersion,omitempty"`
 }
 
 type Envelope struct {
 	Kind string      `json:"kind"`
 	Data interface{} `json:"data"`
+	// Seq 房间内单调递增的事件序号，仅广播事件携带
+	Seq uint64 `json:"seq,omitempty"`
 }
 
 type InboundEnvelope struct {
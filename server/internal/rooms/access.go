@@ -0,0 +1,182 @@
+package rooms
+
+import (
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"wethu/internal/protocol"
+)
+
+var (
+	ErrWrongPassword   = errors.New("wrong password")
+	ErrInvalidPassword = errors.New("invalid password")
+	ErrInviteNotFound  = errors.New("invite not found")
+	ErrInviteExpired   = errors.New("invite expired")
+	ErrInviteExhausted = errors.New("invite exhausted")
+	ErrInvalidInvite   = errors.New("invalid invite options")
+	// ErrPasswordRateLimited 同一 IP 密码错误次数过多
+	ErrPasswordRateLimited = errors.New("too many wrong passwords, try again later")
+)
+
+const (
+	// MaxPasswordLength bcrypt 只使用前 72 字节
+	MaxPasswordLength = 72
+	// DefaultInviteTTL 邀请链接默认有效期
+	DefaultInviteTTL = 24 * time.Hour
+	// MaxInviteTTL 邀请链接最长有效期
+	MaxInviteTTL = 30 * 24 * time.Hour
+	// inviteRetention 邀请过期后继续保留的时长，期间使用仍返回 ErrInviteExpired
+	inviteRetention = 24 * time.Hour
+	// inviteCodeBytes 邀请码随机字节数
+	inviteCodeBytes = 16
+	// DefaultPasswordAttemptLimit 同一 IP 在 DefaultPasswordAttemptWindow 内允许的密码错误次数
+	DefaultPasswordAttemptLimit = 10
+	// DefaultPasswordAttemptWindow 密码错误限流的时间窗口
+	DefaultPasswordAttemptWindow = 10 * time.Minute
+)
+
+// WithPasswordAttemptLimit 设置同一 IP 在 window 内允许的房间密码错误次数，达到后直接拒绝而不再计算 bcrypt；
+// n<=0 表示不限
+func WithPasswordAttemptLimit(n int, window time.Duration) Option {
+	return func(m *Manager) {
+		m.passwordLimiter = newRateLimiter(n, window)
+	}
+}
+
+// WithRoomPassword 为新房间设置密码，为空表示无需密码
+func WithRoomPassword(password string) CreateOption {
+	return func(o *createOptions) {
+		o.password = password
+	}
+}
+
+// JoinOption 加入房间时的可选项
+type JoinOption func(*joinOptions)
+
+type joinOptions struct {
+	password string
+	invite   string
+	// fingerprints 加入者来源摘要，见 WithClientIP
+	fingerprints []string
+	// clientIP 加入者 IP，用于限制密码尝试次数
+	clientIP string
+}
+
+// WithJoinPassword 提供房间密码
+func WithJoinPassword(password string) JoinOption {
+	return func(o *joinOptions) {
+		o.password = password
+	}
+}
+
+// WithInvite 使用邀请码加入，有效的邀请码无需房间密码
+func WithInvite(code string) JoinOption {
+	return func(o *joinOptions) {
+		o.invite = code
+	}
+}
+
+// hashPassword 计算房间密码的 bcrypt 哈希
+func hashPassword(password string) (string, error) {
+	if len(password) > MaxPasswordLength {
+		return "", ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword 校验房间密码，房间未设置密码时直接通过
+func (r *Room) checkPassword(password string) error {
+	r.mu.RLock()
+	hash := r.PasswordHash
+	r.mu.RUnlock()
+	if hash == "" {
+		return nil
+	}
+	// bcrypt 比较较慢，在锁外进行
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// attachWithInvite 凭邀请码加入房间：校验邀请、检查容量、加入与计次在同一次加锁内完成，
+// 满员或加入失败时不消耗邀请次数
+func (r *Room) attachWithInvite(code, userID, name string, now time.Time) (err error) {
+	defer r.persistOnSuccess(&err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invite, err := r.inviteLocked(code, now)
+	if err != nil {
+		return err
+	}
+	if err := r.attachLocked(userID, name, false); err != nil {
+		return err
+	}
+	invite.Uses++
+	return nil
+}
+
+// inviteLocked 返回仍可使用的邀请，调用方需持有 r.mu
+func (r *Room) inviteLocked(code string, now time.Time) (*protocol.Invite, error) {
+	invite, ok := r.Invites[code]
+	if !ok {
+		return nil, ErrInviteNotFound
+	}
+	if !now.Before(invite.ExpiresAt) {
+		return nil, ErrInviteExpired
+	}
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		return nil, ErrInviteExhausted
+	}
+	return invite, nil
+}
+
+// CreateInvite 生成邀请链接，ttl<=0 时使用默认有效期，maxUses 为 0 表示不限次数；需要 invite 权限
+func (r *Room) CreateInvite(senderID string, ttl time.Duration, maxUses int) (_ protocol.Invite, err error) {
+	if ttl <= 0 {
+		ttl = DefaultInviteTTL
+	}
+	if ttl > MaxInviteTTL || maxUses < 0 {
+		return protocol.Invite{}, ErrInvalidInvite
+	}
+
+	defer r.persistOnSuccess(&err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.authorizeLocked(senderID, protocol.PermissionInvite); err != nil {
+		return protocol.Invite{}, err
+	}
+
+	now := time.Now().UTC()
+	r.pruneInvitesLocked(now)
+	invite := &protocol.Invite{
+		Code:      base64.RawURLEncoding.EncodeToString(randomBytes(inviteCodeBytes)),
+		CreatedBy: senderID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		MaxUses:   maxUses,
+	}
+	if r.Invites == nil {
+		r.Invites = make(map[string]*protocol.Invite)
+	}
+	r.Invites[invite.Code] = invite
+	return *invite, nil
+}
+
+// pruneInvitesLocked 删除过期较久的邀请，调用方需持有 r.mu
+func (r *Room) pruneInvitesLocked(now time.Time) {
+	for code, invite := range r.Invites {
+		if now.Sub(invite.ExpiresAt) > inviteRetention {
+			delete(r.Invites, code)
+		}
+	}
+}
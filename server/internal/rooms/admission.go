@@ -0,0 +1,185 @@
+package rooms
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"wethu/internal/protocol"
+)
+
+var (
+	ErrAwaitingAdmission = errors.New("awaiting admission")
+	ErrNotPending        = errors.New("participant is not awaiting admission")
+)
+
+// 拒绝或撤回入场申请的原因
+const (
+	AdmissionDenied = "denied"
+	AdmissionLeft   = "left"
+)
+
+// IsPending 判断参与者是否仍在等候室中
+func (r *Room) IsPending(participantID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	participant, ok := r.Participants[participantID]
+	return ok && participant.Pending
+}
+
+// Admitted 返回参与者被批准入场时关闭的通道，不在等候室中的参与者返回 nil
+func (r *Room) Admitted(participantID string) <-chan struct{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	participant, ok := r.Participants[participantID]
+	if !ok {
+		return nil
+	}
+	return participant.admitted
+}
+
+// RequestAdmission 把等候中参与者的入场申请（JOIN_REQUEST）发给有权审批的成员
+func (r *Room) RequestAdmission(participantID string) {
+	r.mu.RLock()
+	participant, ok := r.Participants[participantID]
+	if !ok || !participant.Pending {
+		r.mu.RUnlock()
+		return
+	}
+	request := joinRequest(participant)
+	admitters := r.admittersLocked()
+	r.mu.RUnlock()
+
+	for _, p := range admitters {
+		p.Send(protocol.Envelope{Kind: "JOIN_REQUEST", Data: request})
+	}
+}
+
+// PendingRequests 返回 participantID 可以审批的入场申请，无审批权限时返回 nil
+func (r *Room) PendingRequests(participantID string) []protocol.JoinRequest {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	participant, ok := r.Participants[participantID]
+	if !ok || participant.Pending || !r.hasPermissionLocked(participant, protocol.PermissionInvite) {
+		return nil
+	}
+	var requests []protocol.JoinRequest
+	for _, p := range r.Participants {
+		if p.Pending {
+			requests = append(requests, joinRequest(p))
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].RequestedAt.Before(requests[j].RequestedAt)
+	})
+	return requests
+}
+
+// Admit 批准等候中的参与者入场；需要 invite 权限
+func (r *Room) Admit(senderID, targetID string) error {
+	r.mu.Lock()
+	target, err := r.pendingTargetLocked(senderID, targetID)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	target.Pending = false
+	// 先把结果放入发送队列，再唤醒等待入场的连接发送房间快照
+	target.Send(protocol.Envelope{
+		Kind: "ADMISSION_RESULT",
+		Data: protocol.AdmissionResult{Admitted: true},
+	})
+	close(target.admitted)
+	var joined *protocol.ParticipantInfo
+	if target.connections > 0 {
+		info := participantInfo(target)
+		joined = &info
+		r.onViewerConnectedLocked()
+	}
+	admitters := r.admittersLocked()
+	resolved := protocol.JoinRequestResolved{UserID: targetID, Admitted: true, DecidedBy: senderID}
+	r.mu.Unlock()
+
+	r.persist()
+	r.notifyResolved(admitters, resolved)
+	if joined != nil {
+		r.Broadcast(protocol.Envelope{Kind: "PARTICIPANT_JOINED", Data: *joined})
+	}
+	return nil
+}
+
+// Deny 拒绝等候中的参与者入场，通知其结果后将其移出房间；需要 invite 权限
+func (r *Room) Deny(senderID, targetID, reason string) error {
+	if reason == "" {
+		reason = AdmissionDenied
+	}
+
+	r.mu.Lock()
+	target, err := r.pendingTargetLocked(senderID, targetID)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	target.Send(protocol.Envelope{
+		Kind: "ADMISSION_RESULT",
+		Data: protocol.AdmissionResult{Admitted: false, Reason: reason},
+	})
+	// 发送队列关闭后连接随之断开
+	r.detachLocked(targetID)
+	admitters := r.admittersLocked()
+	resolved := protocol.JoinRequestResolved{UserID: targetID, Admitted: false, DecidedBy: senderID, Reason: reason}
+	r.mu.Unlock()
+
+	r.persist()
+	r.notifyResolved(admitters, resolved)
+	return nil
+}
+
+// pendingTargetLocked 校验审批权限并查找等候中的参与者，调用方需持有 r.mu
+func (r *Room) pendingTargetLocked(senderID, targetID string) (*Participant, error) {
+	if _, err := r.authorizeLocked(senderID, protocol.PermissionInvite); err != nil {
+		return nil, err
+	}
+	target, ok := r.Participants[targetID]
+	if !ok {
+		return nil, ErrParticipantNotFound
+	}
+	if !target.Pending {
+		return nil, ErrNotPending
+	}
+	return target, nil
+}
+
+// admittersLocked 返回可以审批入场的成员，调用方需持有 r.mu
+func (r *Room) admittersLocked() []*Participant {
+	var admitters []*Participant
+	for _, p := range r.Participants {
+		if !p.Pending && r.hasPermissionLocked(p, protocol.PermissionInvite) {
+			admitters = append(admitters, p)
+		}
+	}
+	return admitters
+}
+
+// notifyResolved 告知审批成员某个入场申请已处理，避免重复审批
+func (r *Room) notifyResolved(admitters []*Participant, resolved protocol.JoinRequestResolved) {
+	for _, p := range admitters {
+		p.Send(protocol.Envelope{Kind: "JOIN_REQUEST_RESOLVED", Data: resolved})
+	}
+}
+
+func joinRequest(p *Participant) protocol.JoinRequest {
+	return protocol.JoinRequest{
+		UserID:      p.ID,
+		DisplayName: p.Name,
+		RequestedAt: p.requestedAt,
+	}
+}
+
+// markPending 让新加入的参与者进入等候室，调用方需持有 r.mu
+func (p *Participant) markPending(now time.Time) {
+	p.Pending = true
+	p.requestedAt = now
+	p.admitted = make(chan struct{})
+}
@@ -0,0 +1,70 @@
+package rooms
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"wethu/internal/protocol"
+)
+
+var (
+	ErrEmptyChatMessage   = errors.New("chat message is empty")
+	ErrChatMessageTooLong = errors.New("chat message is too long")
+)
+
+const (
+	// MaxChatMessageLength 单条聊天消息的最大字符数
+	MaxChatMessageLength = 500
+	// chatHistorySize 每个房间保留的最近聊天消息数量
+	chatHistorySize = 100
+)
+
+// SendChat 校验并记录一条聊天消息，然后广播 CHAT_MESSAGE
+func (r *Room) SendChat(senderID, text string) (protocol.ChatMessage, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return protocol.ChatMessage{}, ErrEmptyChatMessage
+	}
+	if utf8.RuneCountInString(text) > MaxChatMessageLength {
+		return protocol.ChatMessage{}, ErrChatMessageTooLong
+	}
+
+	r.mu.Lock()
+	sender, err := r.authorizeLocked(senderID, protocol.PermissionChat)
+	if err != nil {
+		r.mu.Unlock()
+		return protocol.ChatMessage{}, err
+	}
+	if sender.Muted {
+		r.mu.Unlock()
+		return protocol.ChatMessage{}, ErrMuted
+	}
+	r.ChatCount++
+	message := protocol.ChatMessage{
+		ID:          fmt.Sprintf("msg_%d", r.ChatCount),
+		SenderID:    sender.ID,
+		DisplayName: sender.Name,
+		Text:        text,
+		SentAt:      time.Now().UTC(),
+	}
+	r.touchLocked(message.SentAt)
+	r.ChatHistory = append(r.ChatHistory, message)
+	if overflow := len(r.ChatHistory) - chatHistorySize; overflow > 0 {
+		r.ChatHistory = append([]protocol.ChatMessage(nil), r.ChatHistory[overflow:]...)
+	}
+	r.mu.Unlock()
+
+	r.persist()
+	r.Broadcast(protocol.Envelope{Kind: "CHAT_MESSAGE", Data: message})
+	return message, nil
+}
+
+// ChatMessages 返回最近的聊天记录副本，按时间先后排列
+func (r *Room) ChatMessages() []protocol.ChatMessage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]protocol.ChatMessage{}, r.ChatHistory...)
+}
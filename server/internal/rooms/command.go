@@ -0,0 +1,159 @@
+package rooms
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"time"
+
+	"wethu/internal/protocol"
+)
+
+var (
+	ErrInvalidCommand  = errors.New("invalid playback command")
+	ErrInvalidPosition = errors.New("invalid playback position")
+	ErrInvalidRate     = errors.New("invalid playback rate")
+	ErrInvalidSource   = errors.New("invalid video url")
+)
+
+const (
+	MinPlaybackRate = 0.25
+	MaxPlaybackRate = 4.0
+	maxVideoURLLen  = 2048
+)
+
+// ApplyCommand 校验并执行播放命令，返回需要广播的事件
+func (r *Room) ApplyCommand(senderID string, cmd protocol.PlaybackCommand) (_ protocol.PlaybackEvent, err error) {
+	if err := validateCommand(cmd); err != nil {
+		return protocol.PlaybackEvent{}, err
+	}
+
+	defer r.persistOnSuccess(&err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	participant, err := r.authorizeLocked(senderID, commandPermission(cmd.Type))
+	if err != nil {
+		return protocol.PlaybackEvent{}, err
+	}
+	if err := r.checkRevisionLocked(cmd.BaseRevision); err != nil {
+		return protocol.PlaybackEvent{}, err
+	}
+
+	now := time.Now()
+	// 先把进度推进到当前时刻，再在此基础上应用命令
+	position := r.positionAt(now)
+
+	switch cmd.Type {
+	case protocol.CommandPlay:
+		if cmd.Position != nil {
+			position = *cmd.Position
+		}
+		r.IsPlaying = true
+	case protocol.CommandPause:
+		if cmd.Position != nil {
+			position = *cmd.Position
+		}
+		r.IsPlaying = false
+	case protocol.CommandSeek:
+		position = *cmd.Position
+	case protocol.CommandSetRate:
+		r.PlaybackRate = cmd.Rate
+	case protocol.CommandChangeSource:
+		// 切换片源后从头开始，并等待房主重新播放
+		r.VideoURL = cmd.VideoURL
+		r.IsPlaying = false
+		position = 0
+	case protocol.CommandStop:
+		r.IsPlaying = false
+		position = 0
+	}
+
+	r.Position = position
+	r.AnchorAt = now
+	r.UpdatedAt = now.UTC()
+	r.Revision++
+	r.touchLocked(now)
+
+	cmd.Position = &position
+	cmd.Rate = r.rate()
+	cmd.VideoURL = r.VideoURL
+	cmd.BaseRevision = nil
+	return protocol.PlaybackEvent{
+		Command:   cmd,
+		ActorID:   participant.ID,
+		ActorName: participant.Name,
+		State:     r.stateLocked(now),
+	}, nil
+}
+
+// BroadcastPlayback 广播 PLAYBACK_EVENT，未协商 commands 的连接改为收到同一序号的 ROOM_STATE
+func (r *Room) BroadcastPlayback(event protocol.PlaybackEvent) {
+	r.BroadcastWithFallback(
+		protocol.Envelope{Kind: "PLAYBACK_EVENT", Data: event},
+		protocol.Envelope{Kind: "ROOM_STATE", Data: protocol.RoomStatePayload{Room: event.State}},
+	)
+}
+
+// validateCommand 按命令类型校验必填字段与取值范围
+func validateCommand(cmd protocol.PlaybackCommand) error {
+	switch cmd.Type {
+	case protocol.CommandPlay, protocol.CommandPause:
+		if cmd.Position != nil {
+			return validatePosition(*cmd.Position)
+		}
+	case protocol.CommandSeek:
+		if cmd.Position == nil {
+			return ErrInvalidPosition
+		}
+		return validatePosition(*cmd.Position)
+	case protocol.CommandSetRate:
+		return validateRate(cmd.Rate)
+	case protocol.CommandChangeSource:
+		return validateVideoURL(cmd.VideoURL)
+	case protocol.CommandStop:
+	default:
+		return ErrInvalidCommand
+	}
+	return nil
+}
+
+// validateControl 旧版 CONTROL 与 COMMAND 使用相同的取值校验
+func validateControl(payload protocol.ControlPayload) error {
+	if err := validatePosition(payload.Position); err != nil {
+		return err
+	}
+	if payload.VideoURL != nil {
+		if err := validateVideoURL(*payload.VideoURL); err != nil {
+			return err
+		}
+	}
+	if payload.Rate != nil {
+		return validateRate(*payload.Rate)
+	}
+	return nil
+}
+
+func validatePosition(position float64) error {
+	if math.IsNaN(position) || math.IsInf(position, 0) || position < 0 {
+		return ErrInvalidPosition
+	}
+	return nil
+}
+
+func validateRate(rate float64) error {
+	if math.IsNaN(rate) || rate < MinPlaybackRate || rate > MaxPlaybackRate {
+		return ErrInvalidRate
+	}
+	return nil
+}
+
+func validateVideoURL(raw string) error {
+	if raw == "" || len(raw) > maxVideoURLLen {
+		return ErrInvalidSource
+	}
+	if _, err := url.Parse(raw); err != nil {
+		return ErrInvalidSource
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package rooms
+
+// eventBufferSize 每个房间保留的最近广播事件数量
+const eventBufferSize = 256
+
+type bufferedEvent struct {
+	seq uint64
+	msg *Message
+}
+
+// eventBuffer 固定容量的环形缓冲区，保存已广播的事件用于断线补发
+type eventBuffer struct {
+	events []bufferedEvent
+	start  int
+	count  int
+}
+
+func newEventBuffer(size int) *eventBuffer {
+	return &eventBuffer{events: make([]bufferedEvent, size)}
+}
+
+// append 追加事件，缓冲区已满时覆盖最旧的事件
+func (b *eventBuffer) append(seq uint64, msg *Message) {
+	size := len(b.events)
+	if b.count < size {
+		b.events[(b.start+b.count)%size] = bufferedEvent{seq: seq, msg: msg}
+		b.count++
+		return
+	}
+	b.events[b.start] = bufferedEvent{seq: seq, msg: msg}
+	b.start = (b.start + 1) % size
+}
+
+// since 返回序号大于 lastSeq 的事件；若中间有事件已被覆盖则返回 false
+func (b *eventBuffer) since(lastSeq, currentSeq uint64) ([]*Message, bool) {
+	if lastSeq > currentSeq {
+		return nil, false
+	}
+	if lastSeq == currentSeq {
+		return nil, true
+	}
+	if b.count == 0 {
+		return nil, false
+	}
+
+	size := len(b.events)
+	oldest := b.events[b.start].seq
+	if lastSeq+1 < oldest {
+		return nil, false
+	}
+
+	result := make([]*Message, 0, currentSeq-lastSeq)
+	for i := 0; i < b.count; i++ {
+		event := b.events[(b.start+i)%size]
+		if event.seq > lastSeq {
+			result = append(result, event.msg)
+		}
+	}
+	return result, true
+}
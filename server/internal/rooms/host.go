@@ -0,0 +1,160 @@
+package rooms
+
+import (
+	"context"
+	"time"
+
+	"github.com/RanFeng/ilog"
+
+	"wethu/internal/protocol"
+)
+
+// DefaultHostGracePeriod 房主断线后等待其重连的默认时长，超时后自动移交房主
+const DefaultHostGracePeriod = 30 * time.Second
+
+// 房主变更原因
+const (
+	HostChangeTransfer   = "transfer"
+	HostChangeHostAbsent = "host_absent"
+)
+
+// onHostConnectedLocked 房主在宽限期内回来，取消自动移交，调用方需持有 r.mu
+func (r *Room) onHostConnectedLocked() {
+	r.hostLeftAt = time.Time{}
+	r.stopHostTimerLocked()
+}
+
+// onViewerConnectedLocked 房主缺席期间若之前没有可接任的人，现在重新安排检查，调用方需持有 r.mu
+func (r *Room) onViewerConnectedLocked() {
+	if !r.hostLeftAt.IsZero() && r.hostTimer == nil {
+		r.scheduleHostCheckLocked()
+	}
+}
+
+// onHostDisconnectedLocked 房主完全断开时启动移交计时，并按房间设置自动暂停；
+// 发生暂停时返回新的状态，调用方需持有 r.mu
+func (r *Room) onHostDisconnectedLocked(now time.Time) *protocol.RoomState {
+	r.hostLeftAt = now
+	r.scheduleHostCheckLocked()
+
+	if !r.Settings.AutoPauseOnHostLeave || !r.IsPlaying {
+		return nil
+	}
+	r.Position = r.positionAt(now)
+	r.IsPlaying = false
+	r.AnchorAt = now
+	r.UpdatedAt = now.UTC()
+	r.Revision++
+	state := r.stateLocked(now)
+	return &state
+}
+
+// TransferHost 由当前房主把房主身份移交给 targetID
+func (r *Room) TransferHost(senderID, targetID string) (protocol.HostChanged, error) {
+	r.mu.Lock()
+	sender, ok := r.Participants[senderID]
+	if !ok || !sender.IsHost {
+		r.mu.Unlock()
+		return protocol.HostChanged{}, ErrUnauthorizedControl
+	}
+	if target, ok := r.Participants[targetID]; !ok || target.Pending {
+		r.mu.Unlock()
+		return protocol.HostChanged{}, ErrParticipantNotFound
+	}
+	event := r.changeHostLocked(targetID, HostChangeTransfer)
+	r.mu.Unlock()
+
+	r.persist()
+	r.Broadcast(protocol.Envelope{Kind: "HOST_CHANGED", Data: event})
+	return event, nil
+}
+
+// scheduleHostCheckLocked 在宽限期结束时检查房主是否仍然缺席，调用方需持有 r.mu
+func (r *Room) scheduleHostCheckLocked() {
+	r.stopHostTimerLocked()
+	delay := r.hostGrace - time.Since(r.hostLeftAt)
+	if delay < 0 {
+		delay = 0
+	}
+	r.hostTimer = time.AfterFunc(delay, r.promoteIfHostAbsent)
+}
+
+func (r *Room) stopHostTimerLocked() {
+	if r.hostTimer != nil {
+		r.hostTimer.Stop()
+		r.hostTimer = nil
+	}
+}
+
+// promoteIfHostAbsent 房主超过宽限期未重连时移交房主：优先联合主持人，其次观众，同级中选连接时间最长的在线参与者；
+// 只读的旁观者不会被提升
+func (r *Room) promoteIfHostAbsent() {
+	r.mu.Lock()
+	r.hostTimer = nil
+	if r.hostLeftAt.IsZero() || time.Since(r.hostLeftAt) < r.hostGrace {
+		r.mu.Unlock()
+		return
+	}
+
+	var candidate *Participant
+	for _, p := range r.Participants {
+		if p.IsHost || p.Pending || p.connections == 0 || promotionRank(p) < 0 {
+			continue
+		}
+		if candidate == nil || promotionRank(p) < promotionRank(candidate) ||
+			(promotionRank(p) == promotionRank(candidate) && (p.connectedAt.Before(candidate.connectedAt) ||
+				(p.connectedAt.Equal(candidate.connectedAt) && p.ID < candidate.ID))) {
+			candidate = p
+		}
+	}
+	if candidate == nil {
+		// 暂时没有人可以接任，等下一个参与者连接时再检查
+		r.mu.Unlock()
+		return
+	}
+	event := r.changeHostLocked(candidate.ID, HostChangeHostAbsent)
+	r.mu.Unlock()
+
+	ilog.EventInfo(context.Background(), "host_promoted", "room", r.Id, "host", candidate.ID)
+	r.persist()
+	r.Broadcast(protocol.Envelope{Kind: "HOST_CHANGED", Data: event})
+}
+
+// promotionRank 返回接任房主的优先级，数值越小越优先；不能接任时返回 -1
+func promotionRank(p *Participant) int {
+	switch roleOf(p) {
+	case protocol.RoleCoHost:
+		return 0
+	case protocol.RoleViewer:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// changeHostLocked 切换房主并返回变更事件，调用方需持有 r.mu
+func (r *Room) changeHostLocked(targetID, reason string) protocol.HostChanged {
+	previous := r.OwnerID
+	if old, ok := r.Participants[previous]; ok {
+		old.setRole(protocol.RoleViewer)
+	}
+	target := r.Participants[targetID]
+	target.setRole(protocol.RoleOwner)
+	r.OwnerID = targetID
+
+	r.hostLeftAt = time.Time{}
+	if target.connections == 0 {
+		// 新房主当前不在线，同样进入缺席计时
+		r.hostLeftAt = time.Now()
+		r.scheduleHostCheckLocked()
+	} else {
+		r.stopHostTimerLocked()
+	}
+
+	return protocol.HostChanged{
+		PreviousHostID: previous,
+		HostID:         target.ID,
+		HostName:       target.Name,
+		Reason:         reason,
+	}
+}
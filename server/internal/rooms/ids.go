@@ -0,0 +1,55 @@
+package rooms
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrRoomIDExhausted = errors.New("unable to allocate room id")
+)
+
+const (
+	// roomCodeAlphabet 房间号字符集，去掉了容易混淆的 0/O、1/I/L
+	roomCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	// roomCodeLength 房间号长度，约 39 bit 随机量
+	roomCodeLength = 8
+	// roomCodeAttempts 生成房间号时遇到冲突的最大重试次数
+	roomCodeAttempts = 16
+)
+
+// randomBytes 读取密码学安全的随机字节，系统随机源不可用时无法安全继续，直接 panic
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Errorf("unable to read random bytes: %w", err))
+	}
+	return buf
+}
+
+// generateRoomCode 生成便于口头转述和手动输入的房间号
+func generateRoomCode() string {
+	buf := randomBytes(roomCodeLength)
+	code := make([]byte, roomCodeLength)
+	for i, b := range buf {
+		// 256 不是字符集长度的整数倍，丢弃尾部以避免取模偏差
+		for int(b) >= 256-256%len(roomCodeAlphabet) {
+			b = randomBytes(1)[0]
+		}
+		code[i] = roomCodeAlphabet[int(b)%len(roomCodeAlphabet)]
+	}
+	return string(code)
+}
+
+// normalizeRoomCode 房间号不区分大小写，统一转为大写
+func normalizeRoomCode(roomID string) string {
+	return strings.ToUpper(strings.TrimSpace(roomID))
+}
+
+// generateUserID 生成参与者 ID，仅用于标识，不作为凭证
+func generateUserID() string {
+	return "user_" + hex.EncodeToString(randomBytes(8))
+}
@@ -0,0 +1,132 @@
+package rooms
+
+import (
+	"context"
+	"time"
+
+	"github.com/RanFeng/ilog"
+
+	"wethu/internal/protocol"
+)
+
+// ReapPolicy 后台清理回收房间的策略，字段为 0 表示不启用对应规则
+type ReapPolicy struct {
+	// MaxIdle 房间无任何活动（控制、聊天、播放列表、加入）的最长时间
+	MaxIdle time.Duration
+	// MaxLifetime 房间自创建起的最长存活时间
+	MaxLifetime time.Duration
+	// MaxEmpty 房间内无人在线的最长时间
+	MaxEmpty time.Duration
+}
+
+// DefaultReapPolicy 默认回收策略
+var DefaultReapPolicy = ReapPolicy{
+	MaxIdle:     24 * time.Hour,
+	MaxLifetime: 7 * 24 * time.Hour,
+	MaxEmpty:    30 * time.Minute,
+}
+
+// WithReapPolicy 设置后台清理回收房间的策略
+func WithReapPolicy(policy ReapPolicy) Option {
+	return func(m *Manager) {
+		m.reap = policy
+	}
+}
+
+// CloseRoom 关闭房间：通知在线成员 ROOM_CLOSED 后断开其连接，并从存储与内存中删除
+func (m *Manager) CloseRoom(room *Room, reason string) {
+	room.Close(reason)
+	m.removeRoom(room)
+	ilog.EventInfo(context.Background(), "room_closed", "room", room.ID(), "reason", reason)
+}
+
+// removeRoom 删除已关闭的房间。先将房间标记为关闭，并发的保存不会把房间写回；
+// 先删除存储再移出内存，期间 lookupRoom 仍命中内存中已关闭的房间，不会从存储重新加载出旧房间和旧令牌
+func (m *Manager) removeRoom(room *Room) {
+	roomID := room.ID()
+	if m.store != nil {
+		if err := m.store.Delete(roomID); err != nil {
+			ilog.EventError(context.Background(), err, "delete_room_failed", "room", roomID)
+		}
+	}
+	m.mu.Lock()
+	if current, ok := m.rooms[roomID]; ok && current == room {
+		delete(m.rooms, roomID)
+	}
+	m.mu.Unlock()
+}
+
+// Close 广播 ROOM_CLOSED 并移除全部参与者，之后房间不再写入存储也不能加入；
+// 发送队列中的消息发完后连接随之关闭
+func (r *Room) Close(reason string) {
+	closed := protocol.Envelope{
+		Kind: "ROOM_CLOSED",
+		Data: protocol.RoomClosed{Reason: reason},
+	}
+	r.Broadcast(closed)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for id, p := range r.Participants {
+		if p.Pending {
+			// 广播不会发给等候室，单独通知
+			p.Send(closed)
+		}
+		r.detachLocked(id)
+	}
+	r.stopHostTimerLocked()
+}
+
+// closeIfEmpty 房间没有任何参与者时将其标记为关闭并返回 true，检查与标记在同一次加锁内完成
+func (r *Room) closeIfEmpty() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Participants) > 0 {
+		return false
+	}
+	r.closed = true
+	r.stopHostTimerLocked()
+	return true
+}
+
+// reapReason 按策略判断房间是否应被回收，返回回收原因，不需回收时返回空字符串
+func (r *Room) reapReason(now time.Time, policy ReapPolicy) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if policy.MaxLifetime > 0 && !r.CreatedAt.IsZero() && now.Sub(r.CreatedAt) >= policy.MaxLifetime {
+		return protocol.RoomClosedLifetime
+	}
+	if policy.MaxIdle > 0 && now.Sub(r.lastActiveLocked()) >= policy.MaxIdle {
+		return protocol.RoomClosedIdle
+	}
+	if policy.MaxEmpty > 0 && !r.emptySince.IsZero() && now.Sub(r.emptySince) >= policy.MaxEmpty {
+		return protocol.RoomClosedEmpty
+	}
+	return ""
+}
+
+// touchLocked 记录房间活动时间，调用方需持有 r.mu
+func (r *Room) touchLocked(now time.Time) {
+	r.LastActiveAt = now.UTC()
+}
+
+// lastActiveLocked 返回最近活动时间，兼容没有该字段的旧数据，调用方需持有 r.mu
+func (r *Room) lastActiveLocked() time.Time {
+	if r.LastActiveAt.After(r.UpdatedAt) {
+		return r.LastActiveAt
+	}
+	return r.UpdatedAt
+}
+
+// connectedCountLocked 返回在线参与者数量，调用方需持有 r.mu
+func (r *Room) connectedCountLocked() int {
+	count := 0
+	for _, p := range r.Participants {
+		if p.connections > 0 {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,183 @@
+package rooms
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRoomFull          = errors.New("room is full")
+	ErrRoomLimitReached  = errors.New("server room limit reached")
+	ErrCreateRateLimited = errors.New("too many rooms created, try again later")
+	ErrInvalidCapacity   = errors.New("invalid room capacity")
+)
+
+const (
+	// DefaultMaxParticipants 单个房间默认及最大成员数（含等候室与断线宽限期内的成员）
+	DefaultMaxParticipants = 50
+	// DefaultMaxRooms 服务器同时存在的最大房间数
+	DefaultMaxRooms = 1000
+	// DefaultCreateRateLimit 同一 IP 在 DefaultCreateRateWindow 内最多创建的房间数
+	DefaultCreateRateLimit = 10
+	// DefaultCreateRateWindow 创建房间限流的时间窗口
+	DefaultCreateRateWindow = 10 * time.Minute
+)
+
+// WithParticipantLimit 设置房间成员数上限，创建房间时指定的容量不能超过该值；<=0 表示不限
+func WithParticipantLimit(n int) Option {
+	return func(m *Manager) {
+		m.maxParticipants = n
+	}
+}
+
+// WithRoomLimit 设置服务器同时存在的最大房间数，<=0 表示不限
+func WithRoomLimit(n int) Option {
+	return func(m *Manager) {
+		m.maxRooms = n
+	}
+}
+
+// WithCreateRateLimit 设置同一 IP 在 window 内最多创建的房间数，n<=0 表示不限
+func WithCreateRateLimit(n int, window time.Duration) Option {
+	return func(m *Manager) {
+		m.createLimiter = newRateLimiter(n, window)
+	}
+}
+
+// WithCapacity 指定新房间的成员数上限，为 0 时使用服务器上限
+func WithCapacity(n int) CreateOption {
+	return func(o *createOptions) {
+		o.capacity = n
+	}
+}
+
+// WithCreatorIP 记录创建者 IP，用于按 IP 限制创建频率
+func WithCreatorIP(ip string) CreateOption {
+	return func(o *createOptions) {
+		o.creatorIP = ip
+	}
+}
+
+// roomCapacity 计算房间容量：未指定时取服务器上限，且不能超过服务器上限
+func (m *Manager) roomCapacity(requested int) (int, error) {
+	if requested < 0 || requested == 1 {
+		// 容量至少要容纳房主之外的一人
+		return 0, ErrInvalidCapacity
+	}
+	if m.maxParticipants <= 0 {
+		return requested, nil
+	}
+	if requested == 0 || requested > m.maxParticipants {
+		return m.maxParticipants, nil
+	}
+	return requested, nil
+}
+
+// checkCapacity 判断房间是否还能加入新成员
+func (r *Room) checkCapacity() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.checkCapacityLocked()
+}
+
+// checkCapacityLocked 判断房间是否还能加入新成员，调用方需持有 r.mu
+func (r *Room) checkCapacityLocked() error {
+	if limit := r.Settings.MaxParticipants; limit > 0 && len(r.Participants) >= limit {
+		return ErrRoomFull
+	}
+	return nil
+}
+
+// rateLimiter 按键（客户端 IP）统计滑动时间窗口内的次数
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		hits:   make(map[string][]time.Time),
+	}
+}
+
+// allow 未超过限制时记录一次并返回 true
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	if l == nil || l.limit <= 0 || key == "" {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hits := l.recentLocked(key, now)
+	if len(hits) >= l.limit {
+		l.hits[key] = hits
+		return false
+	}
+	l.hits[key] = append(hits, now)
+	return true
+}
+
+// exceeded 返回窗口内的记录是否已达到限制，不记录本次；用于只统计失败次数的场景
+func (l *rateLimiter) exceeded(key string, now time.Time) bool {
+	if l == nil || l.limit <= 0 || key == "" {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hits := l.recentLocked(key, now)
+	l.hits[key] = hits
+	return len(hits) >= l.limit
+}
+
+// record 记录一次，与 exceeded 配合使用
+func (l *rateLimiter) record(key string, now time.Time) {
+	if l == nil || l.limit <= 0 || key == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hits[key] = append(l.recentLocked(key, now), now)
+}
+
+// undo 撤销最近一次记录，用于请求最终未成功的情况
+func (l *rateLimiter) undo(key string) {
+	if l == nil || l.limit <= 0 || key == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if hits := l.hits[key]; len(hits) > 0 {
+		l.hits[key] = hits[:len(hits)-1]
+	}
+}
+
+// prune 清除窗口外的记录，由后台清理定期调用
+func (l *rateLimiter) prune(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key := range l.hits {
+		if hits := l.recentLocked(key, now); len(hits) > 0 {
+			l.hits[key] = hits
+		} else {
+			delete(l.hits, key)
+		}
+	}
+}
+
+// recentLocked 返回窗口内的记录，调用方需持有 l.mu
+func (l *rateLimiter) recentLocked(key string, now time.Time) []time.Time {
+	hits := l.hits[key]
+	i := 0
+	for i < len(hits) && now.Sub(hits[i]) >= l.window {
+		i++
+	}
+	return hits[i:]
+}
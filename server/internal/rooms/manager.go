@@ -3,9 +3,7 @@ package rooms
 import (
 	"context"
 	"errors"
-	"fmt"
 	"github.com/RanFeng/ilog"
-	"math/rand"
 	"sync"
 	"time"
 
@@ -19,121 +17,522 @@ var (
 )
 
 type Manager struct {
-	mu    sync.RWMutex
-	rooms map[string]*Room
+	mu             sync.RWMutex
+	rooms          map[string]*Room
+	store          RoomStore
+	hostGrace      time.Duration
+	reconnectGrace time.Duration
+	sweepInterval  time.Duration
+	reap           ReapPolicy
+	tokenSecret    []byte
+	tokenTTL       time.Duration
+	tokens         *TokenSigner
+	// maxParticipants 房间成员数上限，maxRooms 房间总数上限，<=0 表示不限
+	maxParticipants int
+	maxRooms        int
+	createLimiter   *rateLimiter
+	// passwordLimiter 按 IP 统计房间密码错误次数
+	passwordLimiter *rateLimiter
+	stop            chan struct{}
+	stopOnce        sync.Once
+	wg              sync.WaitGroup
+}
+
+const (
+	// DefaultReconnectGrace 参与者断线后保留身份、允许凭原令牌重连的默认时长
+	DefaultReconnectGrace = 2 * time.Minute
+	// DefaultSweepInterval 清理过期参与者与空房间的默认周期
+	DefaultSweepInterval = 15 * time.Second
+)
+
+// Option 配置 Manager 的可选项
+type Option func(*Manager)
+
+// WithTokenSecret 设置会话令牌的签名密钥，未设置时每次启动随机生成，重启后旧令牌失效
+func WithTokenSecret(secret []byte) Option {
+	return func(m *Manager) {
+		m.tokenSecret = secret
+	}
+}
+
+// WithTokenTTL 设置会话令牌有效期
+func WithTokenTTL(d time.Duration) Option {
+	return func(m *Manager) {
+		m.tokenTTL = d
+	}
+}
+
+// WithStore 设置房间持久化存储，创建 Manager 时会从中恢复已有房间
+func WithStore(store RoomStore) Option {
+	return func(m *Manager) {
+		m.store = store
+	}
+}
+
+// WithHostGracePeriod 设置房主断线后自动移交房主前的等待时长
+func WithHostGracePeriod(d time.Duration) Option {
+	return func(m *Manager) {
+		m.hostGrace = d
+	}
+}
+
+// WithReconnectGrace 设置参与者断线后保留身份的时长，超时后会被移出房间
+func WithReconnectGrace(d time.Duration) Option {
+	return func(m *Manager) {
+		m.reconnectGrace = d
+	}
+}
+
+// WithSweepInterval 设置后台清理的周期，<= 0 时不启动后台清理
+func WithSweepInterval(d time.Duration) Option {
+	return func(m *Manager) {
+		m.sweepInterval = d
+	}
+}
+
+// CreateOption 创建房间时的可选项
+type CreateOption func(*createOptions)
+
+type createOptions struct {
+	settings  protocol.RoomSettings
+	password  string
+	capacity  int
+	creatorIP string
+}
+
+// WithRoomSettings 指定新房间的设置
+func WithRoomSettings(settings protocol.RoomSettings) CreateOption {
+	return func(o *createOptions) {
+		o.settings = settings
+	}
 }
 
 type Session struct {
-	RoomID string             `json:"roomId"`
-	UserID string             `json:"userId"`
-	Token  string             `json:"token"`
-	IsHost bool               `json:"isHost"`
-	State  protocol.RoomState `json:"state"`
+	RoomID string `json:"roomId"`
+	UserID string `json:"userId"`
+	Token  string `json:"token"`
+	// ExpiresAt 令牌过期时间，过期前应调用刷新接口换发
+	ExpiresAt time.Time          `json:"expiresAt"`
+	IsHost    bool               `json:"isHost"`
+	Role      string             `json:"role"`
+	State     protocol.RoomState `json:"state"`
+	// Chat 加入时的最近聊天记录
+	Chat []protocol.ChatMessage `json:"chat,omitempty"`
+	// Pending 房间开启了等候室，需等待审批；此时 State 只包含房间 ID
+	Pending bool `json:"pending,omitempty"`
 }
 
-func NewManager() *Manager {
-	return &Manager{
-		rooms: make(map[string]*Room),
+func NewManager(opts ...Option) *Manager {
+	m := &Manager{
+		rooms:           make(map[string]*Room),
+		hostGrace:       DefaultHostGracePeriod,
+		reconnectGrace:  DefaultReconnectGrace,
+		sweepInterval:   DefaultSweepInterval,
+		reap:            DefaultReapPolicy,
+		maxParticipants: DefaultMaxParticipants,
+		maxRooms:        DefaultMaxRooms,
+		createLimiter:   newRateLimiter(DefaultCreateRateLimit, DefaultCreateRateWindow),
+		passwordLimiter: newRateLimiter(DefaultPasswordAttemptLimit, DefaultPasswordAttemptWindow),
+		stop:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	m.tokens = NewTokenSigner(m.tokenSecret, m.tokenTTL)
+	if m.store != nil {
+		m.restore()
+	}
+	if m.sweepInterval > 0 {
+		m.wg.Add(1)
+		go m.sweepLoop()
+	}
+	return m
 }
 
-func (m *Manager) CreateRoom(displayName, videoURL string) (*Session, error) {
-	roomID := generateID("room")
-	userID := generateID("user")
-	token := generateID("tok")
+// Close 停止后台清理任务
+func (m *Manager) Close() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+	m.wg.Wait()
+}
 
-	now := time.Now().UTC()
+// sweepLoop 后台清理：定期移除过期的断线参与者，按 ReapPolicy 关闭房间并回收空房间
+func (m *Manager) sweepLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.sweepInterval)
+	defer ticker.Stop()
 
-	room := NewRoom(roomID, userID, videoURL, now)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			m.sweep(now)
+		}
+	}
+}
 
-	m.mu.Lock()
-	m.rooms[roomID] = room
-	m.mu.Unlock()
+// sweep 执行一次清理
+func (m *Manager) sweep(now time.Time) {
+	m.createLimiter.prune(now)
+	m.passwordLimiter.prune(now)
 
-	if err := room.AttachParticipant(userID, displayName, token, true); err != nil {
-		return nil, err
+	m.mu.RLock()
+	snapshot := make([]*Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		snapshot = append(snapshot, room)
 	}
+	m.mu.RUnlock()
 
-	return &Session{
-		RoomID: roomID,
-		UserID: userID,
-		Token:  token,
-		IsHost: true,
-		State:  room.StateSnapshot(),
-	}, nil
+	for _, room := range snapshot {
+		if removed := room.SweepDisconnected(now, m.reconnectGrace); removed > 0 {
+			ilog.EventInfo(context.Background(), "sweep_participants", "room", room.ID(), "removed", removed)
+		}
+		if reason := room.reapReason(now, m.reap); reason != "" {
+			m.CloseRoom(room, reason)
+			continue
+		}
+		m.CleanupRoom(room)
+	}
+}
+
+// restore 从存储中恢复全部房间
+func (m *Manager) restore() {
+	ctx := context.Background()
+	restored, err := m.store.LoadAll()
+	if err != nil {
+		ilog.EventError(ctx, err, "restore_rooms_failed")
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, room := range restored {
+		m.adoptRoom(room)
+		m.rooms[room.ID()] = room
+	}
+	ilog.EventInfo(ctx, "restore_rooms", "count", len(restored))
 }
 
-func (m *Manager) JoinRoom(roomID, displayName string) (*Session, error) {
+// lookupRoom 先查内存，未命中时回落到存储
+func (m *Manager) lookupRoom(roomID string) (*Room, error) {
+	roomID = normalizeRoomCode(roomID)
 	m.mu.RLock()
 	room, ok := m.rooms[roomID]
 	m.mu.RUnlock()
-	if !ok {
+	if ok {
+		return room, nil
+	}
+	if m.store == nil {
 		return nil, ErrRoomNotFound
 	}
 
-	userID := generateID("user")
-	token := generateID("tok")
-	if err := room.AttachParticipant(userID, displayName, token, false); err != nil {
+	loaded, err := m.store.Load(roomID)
+	if err != nil {
+		if errors.Is(err, ErrInvalidRoomID) {
+			return nil, ErrRoomNotFound
+		}
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// 并发加载时以先放入内存的为准
+	if current, ok := m.rooms[roomID]; ok {
+		return current, nil
+	}
+	m.adoptRoom(loaded)
+	m.rooms[roomID] = loaded
+	return loaded, nil
+}
+
+// adoptRoom 为房间注入 Manager 级别的配置
+func (m *Manager) adoptRoom(room *Room) {
+	room.store = m.store
+	room.hostGrace = m.hostGrace
+}
+
+func (m *Manager) CreateRoom(displayName, videoURL string, opts ...CreateOption) (*Session, error) {
+	var options createOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	capacity, err := m.roomCapacity(options.capacity)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	// 先检查频率限制再计算 bcrypt，避免被限流的请求消耗 CPU
+	if !m.createLimiter.allow(options.creatorIP, now) {
+		return nil, ErrCreateRateLimited
+	}
+	var passwordHash string
+	if options.password != "" {
+		hash, err := hashPassword(options.password)
+		if err != nil {
+			m.createLimiter.undo(options.creatorIP)
+			return nil, err
+		}
+		passwordHash = hash
+	}
+
+	userID := generateUserID()
+	m.mu.Lock()
+	if m.maxRooms > 0 && len(m.rooms) >= m.maxRooms {
+		m.mu.Unlock()
+		m.createLimiter.undo(options.creatorIP)
+		return nil, ErrRoomLimitReached
+	}
+	roomID, err := m.allocateRoomIDLocked()
+	if err != nil {
+		m.mu.Unlock()
+		m.createLimiter.undo(options.creatorIP)
+		return nil, err
+	}
+	room := NewRoom(roomID, userID, videoURL, now)
+	room.Settings = options.settings
+	room.Settings.MaxParticipants = capacity
+	room.PasswordHash = passwordHash
+	m.adoptRoom(room)
+	m.rooms[roomID] = room
+	m.mu.Unlock()
+
+	if err := room.AttachParticipant(userID, displayName, true); err != nil {
+		return nil, err
+	}
+	token, expiresAt, err := m.issueToken(room, userID, false)
+	if err != nil {
 		return nil, err
 	}
 
 	return &Session{
-		RoomID: roomID,
-		UserID: userID,
-		Token:  token,
-		IsHost: false,
-		State:  room.StateSnapshot(),
+		RoomID:    roomID,
+		UserID:    userID,
+		Token:     token,
+		ExpiresAt: expiresAt,
+		IsHost:    true,
+		Role:      protocol.RoleOwner,
+		State:     room.StateSnapshot(),
 	}, nil
 }
 
+// JoinRoom 加入房间，房间设置了密码时需要提供密码或有效的邀请码
+func (m *Manager) JoinRoom(roomID, displayName string, opts ...JoinOption) (*Session, error) {
+	var options joinOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	room, err := m.lookupRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := room.checkBanned(options.fingerprints); err != nil {
+		return nil, err
+	}
+	// 先检查容量，满员时不必校验凭据
+	if err := room.checkCapacity(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	userID := generateUserID()
+	if options.invite != "" {
+		// 有效的邀请码无需房间密码；并发加入导致满员时不会消耗邀请次数
+		if err := room.attachWithInvite(options.invite, userID, displayName, now); err != nil {
+			return nil, err
+		}
+	} else {
+		// 先检查密码错误次数再计算 bcrypt，只有密码错误计入限制
+		if m.passwordLimiter.exceeded(options.clientIP, now) {
+			return nil, ErrPasswordRateLimited
+		}
+		if err := room.checkPassword(options.password); err != nil {
+			if errors.Is(err, ErrWrongPassword) {
+				m.passwordLimiter.record(options.clientIP, now)
+			}
+			return nil, err
+		}
+		if err := room.AttachParticipant(userID, displayName, false); err != nil {
+			return nil, err
+		}
+	}
+	room.setFingerprints(userID, options.fingerprints)
+	token, expiresAt, err := m.issueToken(room, userID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		RoomID:    room.ID(),
+		UserID:    userID,
+		Token:     token,
+		ExpiresAt: expiresAt,
+		IsHost:    false,
+		Role:      protocol.RoleViewer,
+	}
+	if room.IsPending(userID) {
+		session.Pending = true
+		session.State = protocol.RoomState{RoomID: room.ID()}
+		room.RequestAdmission(userID)
+		return session, nil
+	}
+	session.State = room.StateSnapshot()
+	session.Chat = room.ChatMessages()
+	return session, nil
+}
+
 func (m *Manager) GetState(roomID string) (protocol.RoomState, error) {
-	m.mu.RLock()
-	room, ok := m.rooms[roomID]
-	m.mu.RUnlock()
-	if !ok {
-		return protocol.RoomState{}, ErrRoomNotFound
+	room, err := m.lookupRoom(roomID)
+	if err != nil {
+		return protocol.RoomState{}, err
 	}
 	return room.StateSnapshot(), nil
 }
 
+// GetChatHistory 返回房间最近的聊天记录
+func (m *Manager) GetChatHistory(roomID string) ([]protocol.ChatMessage, error) {
+	room, err := m.lookupRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return room.ChatMessages(), nil
+}
+
+// GetPlaylist 返回房间的待播放列表
+func (m *Manager) GetPlaylist(roomID string) (protocol.PlaylistState, error) {
+	room, err := m.lookupRoom(roomID)
+	if err != nil {
+		return protocol.PlaylistState{}, err
+	}
+	return room.PlaylistSnapshot(), nil
+}
+
+// GetRoster 返回房间成员列表
+func (m *Manager) GetRoster(roomID string) (protocol.Roster, error) {
+	room, err := m.lookupRoom(roomID)
+	if err != nil {
+		return protocol.Roster{}, err
+	}
+	return room.Roster(), nil
+}
+
+// LookupParticipant 校验令牌签名与有效期，并找到令牌对应的房间和参与者；
+// 只依赖令牌本身和房间成员，房间从存储恢复后原令牌仍然可用
 func (m *Manager) LookupParticipant(roomID, token string) (*Room, *Participant, error) {
-	ctx := context.Background()
-	m.mu.RLock()
-	ilog.EventInfo(ctx, "Looking up participant", "roomID", roomID, "token", token, "m.rooms", m.rooms)
-	room, ok := m.rooms[roomID]
-	m.mu.RUnlock()
-	if !ok {
-		return nil, nil, ErrRoomNotFound
+	claims, err := m.verifyToken(roomID, token)
+	if err != nil {
+		return nil, nil, err
 	}
-	participant, err := room.FindByToken(ctx, token)
+	room, err := m.lookupRoom(claims.RoomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	participant, err := room.FindByClaims(claims)
 	if err != nil {
 		return nil, nil, err
 	}
 	return room, participant, nil
 }
 
-func generateID(prefix string) string {
-	//const size = 6
-	//buf := make([]byte, size)
-	//if _, err := rand.Read(buf); err != nil {
-	//	panic(fmt.Errorf("unable to read random bytes: %w", err))
-	//}
-	r := rand.Intn(900) + 10
-	return fmt.Sprintf("%s_%d", prefix, r)
+// AuthorizeRead 校验令牌属于房间中已入场的成员，供读取房间状态、聊天、播放列表与成员列表的接口使用；
+// 等候室中的成员返回 ErrAwaitingAdmission
+func (m *Manager) AuthorizeRead(roomID, token string) error {
+	room, participant, err := m.LookupParticipant(roomID, token)
+	if err != nil {
+		return err
+	}
+	if room.IsPending(participant.ID) {
+		return ErrAwaitingAdmission
+	}
+	return nil
 }
 
-func (m *Manager) CleanupRoom(room *Room) {
-	if room == nil {
-		return
+// TokenGrant 刷新令牌的结果
+type TokenGrant struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// RefreshToken 用仍然有效的令牌换发新令牌，旧令牌随即失效；新令牌中的角色为参与者当前角色
+func (m *Manager) RefreshToken(roomID, token string) (*TokenGrant, error) {
+	room, participant, err := m.LookupParticipant(roomID, token)
+	if err != nil {
+		return nil, err
 	}
-	if room.ParticipantCount() > 0 {
-		return
+	refreshed, expiresAt, err := m.issueToken(room, participant.ID, true)
+	if err != nil {
+		return nil, err
 	}
-	roomID := room.ID()
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	current, ok := m.rooms[roomID]
-	if ok && current == room {
-		delete(m.rooms, roomID)
+	return &TokenGrant{Token: refreshed, ExpiresAt: expiresAt}, nil
+}
+
+// CreateInvite 以令牌对应的参与者身份生成邀请链接
+func (m *Manager) CreateInvite(roomID, token string, ttl time.Duration, maxUses int) (protocol.Invite, error) {
+	room, participant, err := m.LookupParticipant(roomID, token)
+	if err != nil {
+		return protocol.Invite{}, err
+	}
+	return room.CreateInvite(participant.ID, ttl, maxUses)
+}
+
+// GetAuditTrail 以令牌对应的参与者身份读取房间审计记录
+func (m *Manager) GetAuditTrail(roomID, token string) ([]protocol.AuditEntry, error) {
+	room, participant, err := m.LookupParticipant(roomID, token)
+	if err != nil {
+		return nil, err
+	}
+	return room.AuditTrail(participant.ID)
+}
+
+// verifyToken 校验令牌并确认它属于 roomID 对应的房间
+func (m *Manager) verifyToken(roomID, token string) (TokenClaims, error) {
+	claims, err := m.tokens.Verify(token, time.Now())
+	if err != nil {
+		ilog.EventInfo(context.Background(), "verify_token_failed", "roomID", roomID, "error", err.Error())
+		return claims, err
+	}
+	if claims.RoomID != normalizeRoomCode(roomID) {
+		return claims, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// issueToken 为参与者签发令牌，rotate 为 true 时作废之前签发的令牌
+func (m *Manager) issueToken(room *Room, userID string, rotate bool) (string, time.Time, error) {
+	claims, err := room.tokenClaims(userID, rotate)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if rotate {
+		room.persist()
+	}
+	return m.tokens.Issue(claims, time.Now())
+}
+
+// allocateRoomIDLocked 生成未被占用的房间号，调用方需持有 m.mu
+func (m *Manager) allocateRoomIDLocked() (string, error) {
+	for i := 0; i < roomCodeAttempts; i++ {
+		roomID := generateRoomCode()
+		if _, exists := m.rooms[roomID]; exists {
+			continue
+		}
+		// 存储中可能有尚未载入内存的房间
+		if m.store != nil {
+			if _, err := m.store.Load(roomID); err == nil {
+				continue
+			}
+		}
+		return roomID, nil
+	}
+	return "", ErrRoomIDExhausted
+}
+
+// CleanupRoom 回收已没有任何参与者的房间，与 CloseRoom 一样先标记关闭再删除
+func (m *Manager) CleanupRoom(room *Room) {
+	if room == nil || !room.closeIfEmpty() {
+		return
 	}
+	m.removeRoom(room)
 }
@@ -1,9 +1,19 @@
 package rooms
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/hertz-contrib/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+
 	"wethu/internal/protocol"
 )
 
@@ -222,10 +232,10 @@ func TestApplyControl(t *testing.T) {
 
 	control := protocol.ControlMessage{
 		Payload: protocol.ControlPayload{
-			VideoURL:  &videoURL,
-			Playing:   &playing,
-			Position:  position,
-			IssuedAt:  issuedAt,
+			VideoURL: &videoURL,
+			Playing:  &playing,
+			Position: position,
+			IssuedAt: issuedAt,
 		},
 	}
 
@@ -244,11 +254,1983 @@ func TestApplyControl(t *testing.T) {
 		t.Errorf("IsPlaying mismatch: expected %v, got %v", playing, state.IsPlaying)
 	}
 
+	// 切换片源后从头开始，不沿用客户端上报的旧进度
+	if state.Position != 0 {
+		t.Errorf("Position should reset on source change, got %f", state.Position)
+	}
+
+	// 同一片源的控制使用客户端进度
+	control.Payload.Position = position
+	state, err = room.ApplyControl(participant.ID, control)
+	if err != nil {
+		t.Fatalf("ApplyControl failed: %v", err)
+	}
 	if state.Position != position {
 		t.Errorf("Position mismatch: expected %f, got %f", position, state.Position)
 	}
 
-	if !state.UpdatedAt.Equal(issuedAt) {
-		t.Errorf("UpdatedAt mismatch: expected %v, got %v", issuedAt, state.UpdatedAt)
+	// UpdatedAt 使用服务器时间，不早于客户端发出时间
+	if state.UpdatedAt.Before(issuedAt) {
+		t.Errorf("UpdatedAt should not be before %v, got %v", issuedAt, state.UpdatedAt)
+	}
+
+	// 与 COMMAND 相同的取值校验，非法的进度与片源不会改变状态
+	longURL := "https://example.com/" + strings.Repeat("a", maxVideoURLLen)
+	emptyURL := ""
+	invalid := []struct {
+		payload protocol.ControlPayload
+		want    error
+	}{
+		{payload: protocol.ControlPayload{Position: -1}, want: ErrInvalidPosition},
+		{payload: protocol.ControlPayload{Position: math.NaN()}, want: ErrInvalidPosition},
+		{payload: protocol.ControlPayload{Position: math.Inf(1)}, want: ErrInvalidPosition},
+		{payload: protocol.ControlPayload{Position: 1, VideoURL: &longURL}, want: ErrInvalidSource},
+		{payload: protocol.ControlPayload{Position: 1, VideoURL: &emptyURL}, want: ErrInvalidSource},
+	}
+	for _, tt := range invalid {
+		if _, err := room.ApplyControl(participant.ID, protocol.ControlMessage{Payload: tt.payload}); !errors.Is(err, tt.want) {
+			t.Errorf("ApplyControl(%+v) error = %v, want %v", tt.payload, err, tt.want)
+		}
+	}
+	if after := room.StateSnapshot(); after.Revision != state.Revision || after.VideoURL != videoURL {
+		t.Errorf("rejected controls should not change state, got %+v", after)
+	}
+}
+
+// TestFileStoreRestore 测试重启后从文件存储恢复房间与令牌
+func TestFileStoreRestore(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+
+	secret := WithTokenSecret([]byte("test-secret"))
+	manager := NewManager(WithStore(store), secret)
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	joinSession, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+
+	room, participant, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	playing := true
+	_, err = room.ApplyControl(participant.ID, protocol.ControlMessage{
+		Payload: protocol.ControlPayload{Position: 42, Playing: &playing, IssuedAt: time.Now().UTC()},
+	})
+	if err != nil {
+		t.Fatalf("ApplyControl failed: %v", err)
+	}
+
+	// 模拟重启：使用同一目录创建新的 Manager
+	restarted := NewManager(WithStore(store), secret)
+
+	state, err := restarted.GetState(session.RoomID)
+	if err != nil {
+		t.Fatalf("GetState after restart failed: %v", err)
+	}
+	if state.Position < 42 || !state.IsPlaying {
+		t.Errorf("state not restored: %+v", state)
+	}
+
+	_, viewer, err := restarted.LookupParticipant(session.RoomID, joinSession.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant after restart failed: %v", err)
+	}
+	if viewer.ID != joinSession.UserID {
+		t.Errorf("Participant ID mismatch: expected %s, got %s", joinSession.UserID, viewer.ID)
+	}
+	if viewer.IsHost {
+		t.Error("Viewer should not be host after restore")
+	}
+}
+
+// TestRestoredSeqNeverGoesBack 广播不一定落盘，重启后的序号仍然大于客户端已收到的序号
+func TestRestoredSeqNeverGoesBack(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	secret := WithTokenSecret([]byte("test-secret"))
+
+	for _, broadcasts := range []int{3, seqSaveInterval*2 + 5} {
+		manager := NewManager(WithStore(store), secret)
+		session, err := manager.CreateRoom("Host", "https://example.com/video")
+		if err != nil {
+			t.Fatalf("CreateRoom failed: %v", err)
+		}
+		room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+		if err != nil {
+			t.Fatalf("LookupParticipant failed: %v", err)
+		}
+		// 在线状态之类的事件只广播不落盘
+		for i := 0; i < broadcasts; i++ {
+			room.Broadcast(protocol.Envelope{Kind: "TEST_EVENT", Data: i})
+		}
+		seen := room.StateSnapshot().Seq
+
+		restarted := NewManager(WithStore(store), secret)
+		restored, _, err := restarted.LookupParticipant(session.RoomID, session.Token)
+		if err != nil {
+			t.Fatalf("LookupParticipant after restart failed: %v", err)
+		}
+		if seq := restored.StateSnapshot().Seq; seq <= seen {
+			t.Errorf("after %d broadcasts: restored Seq %d should be greater than %d already sent", broadcasts, seq, seen)
+		}
+		// 重启前的序号无法补发，回退为完整快照
+		if _, ok := restored.EventsSince(seen); ok {
+			t.Errorf("after %d broadcasts: RESUME from %d should fall back to a snapshot", broadcasts, seen)
+		}
+		restored.Broadcast(protocol.Envelope{Kind: "TEST_EVENT", Data: "after restart"})
+		if events, ok := restored.EventsSince(restored.StateSnapshot().Seq - 1); !ok || len(events) != 1 {
+			t.Errorf("after %d broadcasts: events after restart should be replayable, got %d (%v)", broadcasts, len(events), ok)
+		}
+		manager.Close()
+		restarted.Close()
+	}
+}
+
+// TestEventsSince 测试事件序号与补发缓冲区
+func TestEventsSince(t *testing.T) {
+	room := NewRoom("room_1", "user_1", "https://example.com/video", time.Now().UTC())
+	total := eventBufferSize + 10
+	for i := 0; i < total; i++ {
+		room.Broadcast(protocol.Envelope{Kind: "PING", Data: i})
+	}
+
+	if seq := room.StateSnapshot().Seq; seq != uint64(total) {
+		t.Fatalf("Seq mismatch: expected %d, got %d", total, seq)
+	}
+
+	events, ok := room.EventsSince(uint64(total - 3))
+	if !ok {
+		t.Fatal("recent events should be replayable")
+	}
+	if len(events) != 3 {
+		t.Errorf("expected 3 events, got %d", len(events))
+	}
+
+	// 最早的事件已被覆盖，需要回退为完整快照
+	if _, ok := room.EventsSince(1); ok {
+		t.Error("events older than the buffer should not be replayable")
+	}
+
+	// 客户端序号超前（例如服务重启后）同样回退
+	if _, ok := room.EventsSince(uint64(total + 1)); ok {
+		t.Error("future seq should not be replayable")
+	}
+}
+
+// TestStateSnapshotExtrapolatesPosition 测试播放中的快照会按锚点推算当前进度
+func TestStateSnapshotExtrapolatesPosition(t *testing.T) {
+	manager := NewManager()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, participant, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	playing := true
+	if _, err := room.ApplyControl(participant.ID, protocol.ControlMessage{
+		Payload: protocol.ControlPayload{Position: 100, Playing: &playing, IssuedAt: time.Now().UTC()},
+	}); err != nil {
+		t.Fatalf("ApplyControl failed: %v", err)
+	}
+
+	// 将锚点拨回 30 秒前，模拟已经播放了一段时间
+	room.mu.Lock()
+	room.AnchorAt = room.AnchorAt.Add(-30 * time.Second)
+	room.mu.Unlock()
+
+	state, err := manager.GetState(session.RoomID)
+	if err != nil {
+		t.Fatalf("GetState failed: %v", err)
+	}
+	if state.Position < 130 || state.Position > 131 {
+		t.Errorf("expected extrapolated position around 130, got %f", state.Position)
+	}
+
+	// 暂停后进度不再推进
+	paused := false
+	state, err = room.ApplyControl(participant.ID, protocol.ControlMessage{
+		Payload: protocol.ControlPayload{Position: 130, Playing: &paused, IssuedAt: time.Now().UTC()},
+	})
+	if err != nil {
+		t.Fatalf("ApplyControl failed: %v", err)
+	}
+	room.mu.Lock()
+	room.AnchorAt = room.AnchorAt.Add(-30 * time.Second)
+	room.mu.Unlock()
+	if position := room.StateSnapshot().Position; position != 130 {
+		t.Errorf("paused position should stay at 130, got %f", position)
+	}
+}
+
+// TestApplyCommand 测试各类播放命令的语义与校验
+func TestApplyCommand(t *testing.T) {
+	manager := NewManager()
+	session, err := manager.CreateRoom("Host", "https://example.com/video1")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	position := 750.0
+	event, err := room.ApplyCommand(host.ID, protocol.PlaybackCommand{Type: protocol.CommandSeek, Position: &position})
+	if err != nil {
+		t.Fatalf("SEEK failed: %v", err)
+	}
+	if event.State.Position != position || event.ActorName != "Host" {
+		t.Errorf("unexpected SEEK event: %+v", event)
+	}
+
+	event, err = room.ApplyCommand(host.ID, protocol.PlaybackCommand{Type: protocol.CommandPlay})
+	if err != nil {
+		t.Fatalf("PLAY failed: %v", err)
+	}
+	if !event.State.IsPlaying || *event.Command.Position < position {
+		t.Errorf("PLAY should keep position and start playing: %+v", event.State)
+	}
+
+	event, err = room.ApplyCommand(host.ID, protocol.PlaybackCommand{Type: protocol.CommandChangeSource, VideoURL: "https://example.com/video2"})
+	if err != nil {
+		t.Fatalf("CHANGE_SOURCE failed: %v", err)
+	}
+	if event.State.VideoURL != "https://example.com/video2" || event.State.Position != 0 || event.State.IsPlaying {
+		t.Errorf("CHANGE_SOURCE should reset playback: %+v", event.State)
+	}
+
+	invalid := []protocol.PlaybackCommand{
+		{Type: "REWIND"},
+		{Type: protocol.CommandSeek},
+		{Type: protocol.CommandSetRate, Rate: 10},
+		{Type: protocol.CommandChangeSource},
+	}
+	for _, cmd := range invalid {
+		if _, err := room.ApplyCommand(host.ID, cmd); err == nil {
+			t.Errorf("command %+v should be rejected", cmd)
+		}
+	}
+
+	if _, err := room.ApplyCommand(viewer.UserID, protocol.PlaybackCommand{Type: protocol.CommandPause}); !errors.Is(err, ErrUnauthorizedControl) {
+		t.Errorf("Expected ErrUnauthorizedControl, got %v", err)
+	}
+}
+
+// TestPlaybackRate 测试播放速率的校验及其对进度推算的影响
+func TestPlaybackRate(t *testing.T) {
+	manager := NewManager()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, participant, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	if session.State.PlaybackRate != 1 {
+		t.Errorf("default rate should be 1, got %f", session.State.PlaybackRate)
+	}
+
+	tooFast := 16.0
+	if _, err := room.ApplyControl(participant.ID, protocol.ControlMessage{
+		Payload: protocol.ControlPayload{Rate: &tooFast, IssuedAt: time.Now().UTC()},
+	}); err != ErrInvalidRate {
+		t.Errorf("Expected ErrInvalidRate, got %v", err)
+	}
+
+	playing := true
+	rate := 1.5
+	state, err := room.ApplyControl(participant.ID, protocol.ControlMessage{
+		Payload: protocol.ControlPayload{Position: 10, Playing: &playing, Rate: &rate, IssuedAt: time.Now().UTC()},
+	})
+	if err != nil {
+		t.Fatalf("ApplyControl failed: %v", err)
+	}
+	if state.PlaybackRate != rate {
+		t.Errorf("PlaybackRate mismatch: expected %f, got %f", rate, state.PlaybackRate)
+	}
+
+	room.mu.Lock()
+	room.AnchorAt = room.AnchorAt.Add(-20 * time.Second)
+	room.mu.Unlock()
+
+	now := time.Now()
+	if position := room.StateSnapshot().Position; position < 40 || position > 41 {
+		t.Errorf("expected position around 40 at 1.5x, got %f", position)
+	}
+	if drift := room.DriftAt(38, now); drift > -1.9 || drift < -2.1 {
+		t.Errorf("expected drift around -2, got %f", drift)
+	}
+}
+
+// TestStaleRevisionRejected 测试基于过期版本的控制会被拒绝
+func TestStaleRevisionRejected(t *testing.T) {
+	manager := NewManager()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, participant, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	base := session.State.Revision
+	position := 5.0
+	event, err := room.ApplyCommand(participant.ID, protocol.PlaybackCommand{Type: protocol.CommandSeek, Position: &position, BaseRevision: &base})
+	if err != nil {
+		t.Fatalf("ApplyCommand failed: %v", err)
+	}
+	if event.State.Revision != base+1 {
+		t.Errorf("Revision should advance to %d, got %d", base+1, event.State.Revision)
+	}
+
+	// 第二个标签页仍基于旧版本
+	playing := true
+	_, err = room.ApplyControl(participant.ID, protocol.ControlMessage{
+		Payload: protocol.ControlPayload{Position: 0, Playing: &playing, BaseRevision: &base},
+	})
+	if err != ErrStaleRevision {
+		t.Errorf("Expected ErrStaleRevision, got %v", err)
+	}
+
+	// 客户端时间倒退也不会让 UpdatedAt 倒退
+	before := room.StateSnapshot().UpdatedAt
+	state, err := room.ApplyControl(participant.ID, protocol.ControlMessage{
+		Payload: protocol.ControlPayload{Position: 1, IssuedAt: before.Add(-time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("ApplyControl failed: %v", err)
+	}
+	if state.UpdatedAt.Before(before) {
+		t.Errorf("UpdatedAt moved backwards: %v -> %v", before, state.UpdatedAt)
+	}
+	if state.Revision != base+2 {
+		t.Errorf("Revision should advance to %d, got %d", base+2, state.Revision)
+	}
+}
+
+// TestTransferHost 测试房主主动移交
+func TestTransferHost(t *testing.T) {
+	manager := NewManager()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	if _, err := room.TransferHost(viewer.UserID, session.UserID); err != ErrUnauthorizedControl {
+		t.Errorf("Expected ErrUnauthorizedControl, got %v", err)
+	}
+
+	event, err := room.TransferHost(session.UserID, viewer.UserID)
+	if err != nil {
+		t.Fatalf("TransferHost failed: %v", err)
+	}
+	if event.HostID != viewer.UserID || event.PreviousHostID != session.UserID || event.Reason != HostChangeTransfer {
+		t.Errorf("unexpected HOST_CHANGED event: %+v", event)
+	}
+	if state := room.StateSnapshot(); state.OwnerID != viewer.UserID {
+		t.Errorf("OwnerID should be %s, got %s", viewer.UserID, state.OwnerID)
+	}
+}
+
+// TestHostAbsencePromotion 测试房主断线超过宽限期后自动移交并自动暂停
+func TestHostAbsencePromotion(t *testing.T) {
+	manager := NewManager(WithHostGracePeriod(20 * time.Millisecond))
+	session, err := manager.CreateRoom("Host", "https://example.com/video",
+		WithRoomSettings(protocol.RoomSettings{AutoPauseOnHostLeave: true}))
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	first, err := manager.JoinRoom(session.RoomID, "First")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	second, err := manager.JoinRoom(session.RoomID, "Second")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	room.MarkConnected(host.ID)
+	room.MarkConnected(first.UserID)
+	time.Sleep(time.Millisecond)
+	room.MarkConnected(second.UserID)
+
+	if _, err := room.ApplyCommand(host.ID, protocol.PlaybackCommand{Type: protocol.CommandPlay}); err != nil {
+		t.Fatalf("PLAY failed: %v", err)
+	}
+
+	room.MarkDisconnected(host.ID)
+	if room.StateSnapshot().IsPlaying {
+		t.Error("room should auto-pause when host leaves")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for room.StateSnapshot().OwnerID == host.ID && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if owner := room.StateSnapshot().OwnerID; owner != first.UserID {
+		t.Errorf("longest-connected participant %s should be promoted, got %s", first.UserID, owner)
+	}
+}
+
+// TestRolePermissions 测试角色授予、撤销与按权限拒绝
+func TestRolePermissions(t *testing.T) {
+	manager := NewManager()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	if viewer.Role != protocol.RoleViewer {
+		t.Errorf("joiner role should be viewer, got %s", viewer.Role)
+	}
+	room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	position := 30.0
+	_, err = room.ApplyCommand(viewer.UserID, protocol.PlaybackCommand{Type: protocol.CommandSeek, Position: &position})
+	var permErr *PermissionError
+	if !errors.As(err, &permErr) || permErr.Permission != protocol.PermissionSeek {
+		t.Fatalf("expected missing seek permission, got %v", err)
+	}
+
+	// 观众不能给自己升级
+	if _, err := room.GrantRole(viewer.UserID, viewer.UserID, protocol.RoleCoHost); !errors.As(err, &permErr) {
+		t.Errorf("viewer should not grant roles, got %v", err)
+	}
+	if _, err := room.GrantRole(session.UserID, viewer.UserID, protocol.RoleOwner); err != ErrOwnerRoleLocked {
+		t.Errorf("Expected ErrOwnerRoleLocked, got %v", err)
+	}
+
+	if _, err := room.GrantRole(session.UserID, viewer.UserID, protocol.RoleCoHost); err != nil {
+		t.Fatalf("GrantRole failed: %v", err)
+	}
+	if _, err := room.ApplyCommand(viewer.UserID, protocol.PlaybackCommand{Type: protocol.CommandSeek, Position: &position}); err != nil {
+		t.Errorf("cohost should be able to seek: %v", err)
+	}
+
+	// 收回联合主持的跳转权限
+	if _, err := room.SetPermissions(session.UserID, protocol.RoleCoHost, []string{protocol.PermissionPlay}); err != nil {
+		t.Fatalf("SetPermissions failed: %v", err)
+	}
+	_, err = room.ApplyCommand(viewer.UserID, protocol.PlaybackCommand{Type: protocol.CommandSeek, Position: &position})
+	if !errors.As(err, &permErr) || permErr.Permission != protocol.PermissionSeek {
+		t.Errorf("cohost seek permission should be revoked, got %v", err)
+	}
+	if _, err := room.ApplyCommand(viewer.UserID, protocol.PlaybackCommand{Type: protocol.CommandPlay}); err != nil {
+		t.Errorf("cohost should keep play permission: %v", err)
+	}
+
+	if _, err := room.RevokeRole(session.UserID, viewer.UserID); err != nil {
+		t.Fatalf("RevokeRole failed: %v", err)
+	}
+	_, err = room.ApplyCommand(viewer.UserID, protocol.PlaybackCommand{Type: protocol.CommandPause})
+	if !errors.As(err, &permErr) || permErr.Permission != protocol.PermissionPlay {
+		t.Errorf("revoked participant should lose play permission, got %v", err)
+	}
+}
+
+// TestChatHistory 测试聊天消息的长度限制、权限与历史上限
+func TestChatHistory(t *testing.T) {
+	manager := NewManager()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	message, err := room.SendChat(viewer.UserID, "  hello  ")
+	if err != nil {
+		t.Fatalf("SendChat failed: %v", err)
+	}
+	if message.Text != "hello" || message.DisplayName != "Viewer" || message.SentAt.IsZero() {
+		t.Errorf("unexpected chat message: %+v", message)
+	}
+
+	if _, err := room.SendChat(viewer.UserID, "   "); err != ErrEmptyChatMessage {
+		t.Errorf("Expected ErrEmptyChatMessage, got %v", err)
 	}
-}
\ No newline at end of file
+	long := make([]rune, MaxChatMessageLength+1)
+	for i := range long {
+		long[i] = '字'
+	}
+	if _, err := room.SendChat(viewer.UserID, string(long)); err != ErrChatMessageTooLong {
+		t.Errorf("Expected ErrChatMessageTooLong, got %v", err)
+	}
+
+	for i := 0; i < chatHistorySize+5; i++ {
+		if _, err := room.SendChat(session.UserID, "spam"); err != nil {
+			t.Fatalf("SendChat failed: %v", err)
+		}
+	}
+	history, err := manager.GetChatHistory(session.RoomID)
+	if err != nil {
+		t.Fatalf("GetChatHistory failed: %v", err)
+	}
+	if len(history) != chatHistorySize {
+		t.Errorf("history should be capped at %d, got %d", chatHistorySize, len(history))
+	}
+	if history[0].ID == message.ID {
+		t.Error("oldest message should have been evicted")
+	}
+}
+
+// TestPlaylist 测试播放列表的增删、排序、立即播放与自动切换
+func TestPlaylist(t *testing.T) {
+	manager := NewManager()
+	session, err := manager.CreateRoom("Host", "https://example.com/ep1")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	if _, err := room.AddToPlaylist(viewer.UserID, "https://example.com/x", "", false); !errors.Is(err, ErrUnauthorizedControl) {
+		t.Errorf("viewer should not manage playlist, got %v", err)
+	}
+
+	ep2, err := room.AddToPlaylist(session.UserID, "https://example.com/ep2", "Episode 2", false)
+	if err != nil {
+		t.Fatalf("AddToPlaylist failed: %v", err)
+	}
+	ep3, err := room.AddToPlaylist(session.UserID, "https://example.com/ep3", "Episode 3", false)
+	if err != nil {
+		t.Fatalf("AddToPlaylist failed: %v", err)
+	}
+	extra, err := room.AddToPlaylist(session.UserID, "https://example.com/extra", "Extra", true)
+	if err != nil {
+		t.Fatalf("AddToPlaylist failed: %v", err)
+	}
+
+	playlist, err := manager.GetPlaylist(session.RoomID)
+	if err != nil {
+		t.Fatalf("GetPlaylist failed: %v", err)
+	}
+	if len(playlist.Items) != 3 || playlist.Items[0].ID != extra.ID {
+		t.Fatalf("playNext item should be first: %+v", playlist.Items)
+	}
+
+	if err := room.RemoveFromPlaylist(session.UserID, extra.ID); err != nil {
+		t.Fatalf("RemoveFromPlaylist failed: %v", err)
+	}
+	if err := room.MovePlaylistItem(session.UserID, ep3.ID, 0); err != nil {
+		t.Fatalf("MovePlaylistItem failed: %v", err)
+	}
+	if err := room.MovePlaylistItem(session.UserID, ep3.ID, 5); err != ErrInvalidPlaylistIndex {
+		t.Errorf("Expected ErrInvalidPlaylistIndex, got %v", err)
+	}
+
+	// 当前片源结束，自动切到队首的 ep3
+	event, advanced, err := room.MediaEnded(session.UserID, "https://example.com/ep1")
+	if err != nil || !advanced {
+		t.Fatalf("MediaEnded should advance: advanced=%v err=%v", advanced, err)
+	}
+	if event.State.VideoURL != ep3.VideoURL || event.State.Position != 0 || !event.State.IsPlaying {
+		t.Errorf("unexpected state after advance: %+v", event.State)
+	}
+
+	// 重复上报上一个片源的结束不会再次切换
+	if _, advanced, _ := room.MediaEnded(session.UserID, "https://example.com/ep1"); advanced {
+		t.Error("duplicate MEDIA_ENDED should not advance twice")
+	}
+
+	event, err = room.PlayNow(session.UserID, "")
+	if err != nil {
+		t.Fatalf("PlayNow failed: %v", err)
+	}
+	if event.State.VideoURL != ep2.VideoURL {
+		t.Errorf("PlayNow should play %s, got %s", ep2.VideoURL, event.State.VideoURL)
+	}
+	if _, err := room.PlayNow(session.UserID, ""); err != ErrPlaylistEmpty {
+		t.Errorf("Expected ErrPlaylistEmpty, got %v", err)
+	}
+
+	// 只能管理播放列表、不能切换片源的角色不能立即播放
+	if _, err := room.SetPermissions(session.UserID, protocol.RoleViewer, []string{protocol.PermissionChat, protocol.PermissionManagePlaylist}); err != nil {
+		t.Fatalf("SetPermissions failed: %v", err)
+	}
+	item, err := room.AddToPlaylist(viewer.UserID, "https://example.com/ep4", "", false)
+	if err != nil {
+		t.Fatalf("viewer with manage_playlist should add items: %v", err)
+	}
+	var permErr *PermissionError
+	if _, err := room.PlayNow(viewer.UserID, item.ID); !errors.As(err, &permErr) || permErr.Permission != protocol.PermissionChangeSource {
+		t.Errorf("PlayNow without change_source should be rejected, got %v", err)
+	}
+}
+
+// TestRosterPresence 测试成员上下线状态与成员列表
+func TestRosterPresence(t *testing.T) {
+	manager := NewManager()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	room.MarkConnected(host.ID)
+	room.MarkConnected(viewer.UserID)
+	room.MarkConnected(viewer.UserID)
+	room.MarkDisconnected(viewer.UserID)
+
+	roster, err := manager.GetRoster(session.RoomID)
+	if err != nil {
+		t.Fatalf("GetRoster failed: %v", err)
+	}
+	if len(roster.Participants) != 2 {
+		t.Fatalf("expected 2 participants, got %d", len(roster.Participants))
+	}
+	for _, info := range roster.Participants {
+		// 观众仍有一个标签页在线
+		if info.Status != protocol.ParticipantConnected {
+			t.Errorf("%s should be connected, got %s", info.Name, info.Status)
+		}
+		if info.ID == host.ID && info.Role != protocol.RoleOwner {
+			t.Errorf("host role should be owner, got %s", info.Role)
+		}
+	}
+
+	room.MarkDisconnected(viewer.UserID)
+	for _, info := range room.Roster().Participants {
+		if info.ID == viewer.UserID && info.Status != protocol.ParticipantDisconnected {
+			t.Errorf("viewer should be disconnected, got %s", info.Status)
+		}
+	}
+}
+
+// TestReconnectGraceSweep 测试宽限期内可凭原令牌重连，过期后被移除并回收空房间
+func TestReconnectGraceSweep(t *testing.T) {
+	manager := NewManager(WithReconnectGrace(time.Minute), WithSweepInterval(0))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	room.MarkConnected(host.ID)
+	room.MarkConnected(viewer.UserID)
+	drainKinds(host)
+	room.MarkDisconnected(viewer.UserID)
+	if left := leftStatuses(host); len(left) != 1 || left[0] != protocol.ParticipantDisconnected {
+		t.Errorf("expected PARTICIPANT_LEFT with disconnected status, got %v", left)
+	}
+
+	// 宽限期内清理不会移除观众，且原令牌仍能找回同一身份
+	manager.sweep(time.Now().Add(30 * time.Second))
+	_, again, err := manager.LookupParticipant(session.RoomID, viewer.Token)
+	if err != nil {
+		t.Fatalf("reconnect within grace failed: %v", err)
+	}
+	if again.ID != viewer.UserID || again.Status() != protocol.ParticipantDisconnected {
+		t.Errorf("unexpected participant after reconnect lookup: %s %s", again.ID, again.Status())
+	}
+	room.MarkConnected(again.ID)
+	if again.Status() != protocol.ParticipantConnected {
+		t.Errorf("participant should be connected, got %s", again.Status())
+	}
+	room.MarkDisconnected(again.ID)
+	drainKinds(host)
+
+	// 宽限期过后观众被移除，令牌失效，其他成员收到 gone 状态的 PARTICIPANT_LEFT
+	manager.sweep(time.Now().Add(2 * time.Minute))
+	if left := leftStatuses(host); len(left) != 1 || left[0] != protocol.ParticipantGone {
+		t.Errorf("expected PARTICIPANT_LEFT with gone status after grace, got %v", left)
+	}
+	if _, _, err := manager.LookupParticipant(session.RoomID, viewer.Token); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken after grace, got %v", err)
+	}
+	if room.ParticipantCount() != 1 {
+		t.Errorf("only the connected host should remain, got %d", room.ParticipantCount())
+	}
+
+	// 房主也离开后房间被回收
+	room.MarkDisconnected(host.ID)
+	manager.sweep(time.Now().Add(2 * time.Minute))
+	if _, err := manager.GetState(session.RoomID); err != ErrRoomNotFound {
+		t.Errorf("empty room should be cleaned up, got %v", err)
+	}
+}
+
+// leftStatuses 取出参与者队列中的消息，返回其中 PARTICIPANT_LEFT 携带的状态
+func leftStatuses(p *Participant) []string {
+	var statuses []string
+	messages, _, _ := p.send.take(nil, outboundHardLimit)
+	for _, msg := range messages {
+		data, _ := msg.Encode(protocol.JSONCodec)
+		var envelope struct {
+			Kind string                   `json:"kind"`
+			Data protocol.ParticipantInfo `json:"data"`
+		}
+		if err := json.Unmarshal(data, &envelope); err == nil && envelope.Kind == "PARTICIPANT_LEFT" {
+			statuses = append(statuses, envelope.Data.Status)
+		}
+	}
+	return statuses
+}
+
+func TestReapPolicy(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0), WithReapPolicy(ReapPolicy{MaxIdle: time.Hour, MaxEmpty: 10 * time.Minute}))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	room.MarkConnected(host.ID)
+
+	// 有人在线且仍在活动期内，不回收
+	manager.sweep(time.Now().Add(30 * time.Minute))
+	if _, err := manager.GetState(session.RoomID); err != nil {
+		t.Fatalf("active room should stay, got %v", err)
+	}
+
+	// 超过空闲时间后房间被关闭，在线成员收到 ROOM_CLOSED 后发送队列关闭
+	manager.sweep(time.Now().Add(2 * time.Hour))
+	if _, err := manager.GetState(session.RoomID); err != ErrRoomNotFound {
+		t.Fatalf("idle room should be closed, got %v", err)
+	}
+	var closed protocol.Envelope
+	var data protocol.RoomClosed
+	closed.Data = &data
+	messages, queueClosed, _ := host.send.take(nil, outboundHardLimit)
+	for _, msg := range messages {
+		data, _ := msg.Encode(protocol.JSONCodec)
+		if err := json.Unmarshal(data, &closed); err == nil && closed.Kind == "ROOM_CLOSED" {
+			break
+		}
+	}
+	if closed.Kind != "ROOM_CLOSED" || data.Reason != protocol.RoomClosedIdle {
+		t.Errorf("expected ROOM_CLOSED idle_timeout, got %s %q", closed.Kind, data.Reason)
+	}
+	if !queueClosed {
+		t.Error("send queue should be closed after ROOM_CLOSED")
+	}
+
+	// 无人在线超过 MaxEmpty 的房间同样被关闭
+	other, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	manager.sweep(time.Now().Add(20 * time.Minute))
+	if _, err := manager.GetState(other.RoomID); err != ErrRoomNotFound {
+		t.Errorf("empty room should be closed, got %v", err)
+	}
+}
+
+func TestRoomCodesAndTokens(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0))
+	defer manager.Close()
+
+	seen := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		session, err := manager.CreateRoom("Host", "https://example.com/video")
+		if err != nil {
+			t.Fatalf("CreateRoom failed: %v", err)
+		}
+		if len(session.RoomID) != roomCodeLength || strings.Trim(session.RoomID, roomCodeAlphabet) != "" {
+			t.Fatalf("unexpected room code %q", session.RoomID)
+		}
+		if seen[session.RoomID] || tokens[session.Token] {
+			t.Fatalf("duplicate room code or token: %s %s", session.RoomID, session.Token)
+		}
+		seen[session.RoomID] = true
+		tokens[session.Token] = true
+	}
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	// 房间号不区分大小写
+	if _, _, err := manager.LookupParticipant(strings.ToLower(session.RoomID), session.Token); err != nil {
+		t.Errorf("lowercase room code lookup failed: %v", err)
+	}
+	// 猜测的令牌无法通过校验
+	forged := session.Token[:len(session.Token)-1] + "A"
+	if forged == session.Token {
+		forged = session.Token[:len(session.Token)-1] + "B"
+	}
+	for _, token := range []string{forged, "tok_123", ""} {
+		if _, _, err := manager.LookupParticipant(session.RoomID, token); err != ErrInvalidToken {
+			t.Errorf("token %q: expected ErrInvalidToken, got %v", token, err)
+		}
+	}
+}
+
+func TestSignedTokens(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0), WithTokenSecret([]byte("test-secret")), WithTokenTTL(time.Hour))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	other, err := manager.CreateRoom("Other", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+
+	claims, err := manager.tokens.Verify(session.Token, time.Now())
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if claims.RoomID != session.RoomID || claims.UserID != session.UserID || claims.Role != protocol.RoleOwner {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	if _, err := manager.tokens.Verify(session.Token, time.Now().Add(2*time.Hour)); err != ErrTokenExpired {
+		t.Errorf("Expected ErrTokenExpired, got %v", err)
+	}
+
+	// 其它房间的令牌、篡改过的令牌以及不同密钥签发的令牌都无效
+	if _, _, err := manager.LookupParticipant(session.RoomID, other.Token); err != ErrInvalidToken {
+		t.Errorf("token of another room: expected ErrInvalidToken, got %v", err)
+	}
+	parts := strings.Split(session.Token, ".")
+	tampered := parts[0] + "." + parts[1] + "x." + parts[2]
+	if _, _, err := manager.LookupParticipant(session.RoomID, tampered); err != ErrInvalidToken {
+		t.Errorf("tampered token: expected ErrInvalidToken, got %v", err)
+	}
+	foreign := NewManager(WithSweepInterval(0), WithTokenSecret([]byte("other-secret")))
+	defer foreign.Close()
+	if _, err := foreign.tokens.Verify(session.Token, time.Now()); err != ErrInvalidToken {
+		t.Errorf("foreign secret: expected ErrInvalidToken, got %v", err)
+	}
+
+	// 刷新后旧令牌失效，新令牌可用
+	grant, err := manager.RefreshToken(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("RefreshToken failed: %v", err)
+	}
+	if !grant.ExpiresAt.After(time.Now()) {
+		t.Errorf("refreshed token should expire in the future, got %v", grant.ExpiresAt)
+	}
+	if _, _, err := manager.LookupParticipant(session.RoomID, session.Token); err != ErrInvalidToken {
+		t.Errorf("old token after refresh: expected ErrInvalidToken, got %v", err)
+	}
+	if _, participant, err := manager.LookupParticipant(session.RoomID, grant.Token); err != nil || participant.ID != session.UserID {
+		t.Errorf("refreshed token lookup failed: %v", err)
+	}
+}
+
+func TestRoomPasswordAndInvites(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video", WithRoomPassword("s3cret"))
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	if !session.State.HasPassword {
+		t.Error("state should report the room as password protected")
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	if room.PasswordHash == "" || room.PasswordHash == "s3cret" {
+		t.Errorf("password should be stored hashed, got %q", room.PasswordHash)
+	}
+
+	if _, err := manager.JoinRoom(session.RoomID, "Viewer"); err != ErrWrongPassword {
+		t.Errorf("join without password: expected ErrWrongPassword, got %v", err)
+	}
+	if _, err := manager.JoinRoom(session.RoomID, "Viewer", WithJoinPassword("guess")); err != ErrWrongPassword {
+		t.Errorf("join with wrong password: expected ErrWrongPassword, got %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer", WithJoinPassword("s3cret"))
+	if err != nil {
+		t.Fatalf("join with password failed: %v", err)
+	}
+
+	// 观众默认没有生成邀请的权限
+	if _, err := room.CreateInvite(viewer.UserID, time.Hour, 1); !errors.Is(err, ErrUnauthorizedControl) {
+		t.Errorf("viewer invite: expected permission error, got %v", err)
+	}
+
+	invite, err := room.CreateInvite(host.ID, time.Hour, 1)
+	if err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+	if _, err := manager.JoinRoom(session.RoomID, "Guest", WithInvite(invite.Code)); err != nil {
+		t.Fatalf("join with invite failed: %v", err)
+	}
+	if _, err := manager.JoinRoom(session.RoomID, "Guest2", WithInvite(invite.Code)); err != ErrInviteExhausted {
+		t.Errorf("expected ErrInviteExhausted, got %v", err)
+	}
+	if _, err := manager.JoinRoom(session.RoomID, "Guest3", WithInvite("unknown")); err != ErrInviteNotFound {
+		t.Errorf("expected ErrInviteNotFound, got %v", err)
+	}
+
+	unlimited, err := room.CreateInvite(host.ID, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+	if err := room.attachWithInvite(unlimited.Code, "user_late", "Late", time.Now().Add(2*time.Hour)); err != ErrInviteExpired {
+		t.Errorf("expected ErrInviteExpired, got %v", err)
+	}
+}
+
+// TestInviteNotConsumedWhenFull 满员时凭邀请加入失败，不消耗邀请次数
+func TestInviteNotConsumedWhenFull(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video", WithCapacity(2))
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	invite, err := room.CreateInvite(host.ID, time.Hour, 1)
+	if err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+
+	// 绕过 JoinRoom 的提前检查，模拟检查之后房间被并发的加入占满
+	if err := room.attachWithInvite(invite.Code, "user_late", "Late", time.Now()); err != ErrRoomFull {
+		t.Fatalf("expected ErrRoomFull, got %v", err)
+	}
+	if uses := room.Invites[invite.Code].Uses; uses != 0 {
+		t.Errorf("invite rejected as full should not be consumed, got %d uses", uses)
+	}
+
+	room.DetachParticipant(viewer.UserID)
+	if _, err := manager.JoinRoom(session.RoomID, "Guest", WithInvite(invite.Code)); err != nil {
+		t.Fatalf("join with invite after a slot opened failed: %v", err)
+	}
+	if uses := room.Invites[invite.Code].Uses; uses != 1 {
+		t.Errorf("successful invite join should count one use, got %d", uses)
+	}
+}
+
+// TestPasswordAttemptLimit 同一 IP 密码错误次数达到上限后直接拒绝，正确的密码不计入限制
+func TestPasswordAttemptLimit(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0), WithPasswordAttemptLimit(2, time.Minute))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video", WithRoomPassword("s3cret"))
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+
+	// 成功加入不消耗次数
+	for i := 0; i < 3; i++ {
+		if _, err := manager.JoinRoom(session.RoomID, "Viewer", WithJoinPassword("s3cret"), WithClientIP("10.0.0.1")); err != nil {
+			t.Fatalf("join %d with password failed: %v", i, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := manager.JoinRoom(session.RoomID, "Guesser", WithJoinPassword("guess"), WithClientIP("10.0.0.2")); err != ErrWrongPassword {
+			t.Fatalf("guess %d: expected ErrWrongPassword, got %v", i, err)
+		}
+	}
+	// 达到上限后即使密码正确也被拒绝，不再计算 bcrypt
+	if _, err := manager.JoinRoom(session.RoomID, "Guesser", WithJoinPassword("s3cret"), WithClientIP("10.0.0.2")); err != ErrPasswordRateLimited {
+		t.Errorf("expected ErrPasswordRateLimited, got %v", err)
+	}
+	// 其它 IP 不受影响
+	if _, err := manager.JoinRoom(session.RoomID, "Viewer", WithJoinPassword("s3cret"), WithClientIP("10.0.0.3")); err != nil {
+		t.Errorf("join from another IP failed: %v", err)
+	}
+	// 窗口过后恢复
+	manager.passwordLimiter.prune(time.Now().Add(time.Minute))
+	if manager.passwordLimiter.exceeded("10.0.0.2", time.Now().Add(time.Minute)) {
+		t.Error("attempts should expire after the window")
+	}
+}
+
+// drainKinds 读出发送队列中已有的消息类型
+func drainKinds(p *Participant) []string {
+	var kinds []string
+	messages, _, _ := p.send.take(nil, outboundHardLimit)
+	for _, msg := range messages {
+		data, _ := msg.Encode(protocol.JSONCodec)
+		var envelope protocol.InboundEnvelope
+		if err := json.Unmarshal(data, &envelope); err == nil {
+			kinds = append(kinds, envelope.Kind)
+		}
+	}
+	return kinds
+}
+
+func containsKind(kinds []string, kind string) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWaitingRoom(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video",
+		WithRoomSettings(protocol.RoomSettings{WaitingRoom: true}))
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	room.MarkConnected(host.ID)
+	drainKinds(host)
+
+	guest, err := manager.JoinRoom(session.RoomID, "Guest")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	if !guest.Pending || guest.State.VideoURL != "" {
+		t.Errorf("joiner should be pending without room state: %+v", guest)
+	}
+	if kinds := drainKinds(host); !containsKind(kinds, "JOIN_REQUEST") {
+		t.Errorf("host should receive JOIN_REQUEST, got %v", kinds)
+	}
+	if requests := room.PendingRequests(host.ID); len(requests) != 1 || requests[0].UserID != guest.UserID {
+		t.Errorf("unexpected pending requests: %+v", requests)
+	}
+
+	_, pending, err := manager.LookupParticipant(session.RoomID, guest.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	room.MarkConnected(pending.ID)
+	// 等候中的参与者不在成员列表中，收不到广播，也不能操作
+	if len(room.Roster().Participants) != 1 {
+		t.Errorf("pending participant should not be in roster: %+v", room.Roster())
+	}
+	if _, err := room.SendChat(pending.ID, "hi"); err != ErrAwaitingAdmission {
+		t.Errorf("expected ErrAwaitingAdmission, got %v", err)
+	}
+	if _, err := room.SendChat(host.ID, "welcome"); err != nil {
+		t.Fatalf("SendChat failed: %v", err)
+	}
+	if kinds := drainKinds(pending); len(kinds) != 0 {
+		t.Errorf("pending participant should not receive broadcasts, got %v", kinds)
+	}
+
+	admitted := room.Admitted(pending.ID)
+	if err := room.Admit(host.ID, pending.ID); err != nil {
+		t.Fatalf("Admit failed: %v", err)
+	}
+	select {
+	case <-admitted:
+	default:
+		t.Error("admitted channel should be closed")
+	}
+	if kinds := drainKinds(pending); len(kinds) == 0 || kinds[0] != "ADMISSION_RESULT" {
+		t.Errorf("admitted participant should be told first, got %v", kinds)
+	}
+	if err := room.Admit(host.ID, pending.ID); err != ErrNotPending {
+		t.Errorf("expected ErrNotPending, got %v", err)
+	}
+
+	// 被拒绝的申请者收到结果后被移出房间，令牌失效
+	denied, err := manager.JoinRoom(session.RoomID, "Stranger")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	_, stranger, err := manager.LookupParticipant(session.RoomID, denied.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	if err := room.Deny(pending.ID, stranger.ID, ""); !errors.Is(err, ErrUnauthorizedControl) {
+		t.Errorf("viewer deny: expected permission error, got %v", err)
+	}
+	if err := room.Deny(host.ID, stranger.ID, "private"); err != nil {
+		t.Fatalf("Deny failed: %v", err)
+	}
+	if kinds := drainKinds(stranger); len(kinds) != 1 || kinds[0] != "ADMISSION_RESULT" {
+		t.Errorf("denied participant should only receive the result, got %v", kinds)
+	}
+	if _, _, err := manager.LookupParticipant(session.RoomID, denied.Token); err != ErrInvalidToken {
+		t.Errorf("denied token: expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestModeration(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	troll, err := manager.JoinRoom(session.RoomID, "Troll", WithClientIP("203.0.113.7"))
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+
+	// 观众没有管理权限，也不能管理房主
+	if err := room.Kick(viewer.UserID, troll.UserID, ""); !errors.Is(err, ErrUnauthorizedControl) {
+		t.Errorf("viewer kick: expected permission error, got %v", err)
+	}
+	if _, err := room.GrantRole(host.ID, viewer.UserID, protocol.RoleCoHost); err != nil {
+		t.Fatalf("GrantRole failed: %v", err)
+	}
+	if err := room.Kick(viewer.UserID, host.ID, ""); err != ErrCannotModerate {
+		t.Errorf("cohost kicking owner: expected ErrCannotModerate, got %v", err)
+	}
+
+	// 禁言后不能聊天，解除后恢复
+	if err := room.SetMuted(viewer.UserID, troll.UserID, true, "spam"); err != nil {
+		t.Fatalf("SetMuted failed: %v", err)
+	}
+	if _, err := room.SendChat(troll.UserID, "spam"); err != ErrMuted {
+		t.Errorf("expected ErrMuted, got %v", err)
+	}
+	if err := room.SetMuted(viewer.UserID, troll.UserID, false, ""); err != nil {
+		t.Fatalf("SetMuted failed: %v", err)
+	}
+	if _, err := room.SendChat(troll.UserID, "sorry"); err != nil {
+		t.Errorf("unmuted chat failed: %v", err)
+	}
+
+	// 封禁后被移出房间，同一 IP 无法再次加入；踢出的成员可以重新加入
+	_, trollParticipant, err := manager.LookupParticipant(session.RoomID, troll.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	drainKinds(trollParticipant)
+	if err := room.Ban(host.ID, troll.UserID, "abuse"); err != nil {
+		t.Fatalf("Ban failed: %v", err)
+	}
+	if kinds := drainKinds(trollParticipant); len(kinds) != 1 || kinds[0] != "KICKED" {
+		t.Errorf("banned participant should be told before disconnect, got %v", kinds)
+	}
+	if _, _, err := manager.LookupParticipant(session.RoomID, troll.Token); err != ErrBanned {
+		t.Errorf("banned token: expected ErrBanned, got %v", err)
+	}
+	if _, err := manager.JoinRoom(session.RoomID, "Troll2", WithClientIP("203.0.113.7")); err != ErrBanned {
+		t.Errorf("rejoin from banned IP: expected ErrBanned, got %v", err)
+	}
+
+	guest, err := manager.JoinRoom(session.RoomID, "Guest", WithClientIP("198.51.100.1"))
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	if err := room.Kick(host.ID, guest.UserID, "bye"); err != nil {
+		t.Fatalf("Kick failed: %v", err)
+	}
+	if _, err := manager.JoinRoom(session.RoomID, "Guest", WithClientIP("198.51.100.1")); err != nil {
+		t.Errorf("kicked participant should be able to rejoin: %v", err)
+	}
+
+	entries, err := manager.GetAuditTrail(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("GetAuditTrail failed: %v", err)
+	}
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	if strings.Join(actions, ",") != "mute,unmute,ban,kick" {
+		t.Errorf("unexpected audit trail: %v", actions)
+	}
+	if _, err := room.AuditTrail(troll.UserID); err == nil {
+		t.Error("removed participant should not read the audit trail")
+	}
+}
+
+func TestCapacityAndQuotas(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0), WithParticipantLimit(3), WithRoomLimit(3),
+		WithCreateRateLimit(2, time.Minute))
+	defer manager.Close()
+
+	// 指定容量不能超过服务器上限
+	big, err := manager.CreateRoom("Host", "https://example.com/video", WithCapacity(100))
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	if big.State.Settings.MaxParticipants != 3 {
+		t.Errorf("capacity should be capped at 3, got %d", big.State.Settings.MaxParticipants)
+	}
+
+	small, err := manager.CreateRoom("Host", "https://example.com/video", WithCapacity(2))
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	if _, err := manager.JoinRoom(small.RoomID, "Viewer"); err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	if _, err := manager.JoinRoom(small.RoomID, "Late"); err != ErrRoomFull {
+		t.Errorf("expected ErrRoomFull, got %v", err)
+	}
+
+	// 同一 IP 超过创建频率后被拒绝，其它 IP 不受影响
+	for i := 0; i < 2; i++ {
+		if !manager.createLimiter.allow("198.51.100.9", time.Now()) {
+			t.Fatalf("attempt %d should be allowed", i)
+		}
+	}
+	if _, err := manager.CreateRoom("Host", "https://example.com/video", WithCreatorIP("198.51.100.9")); err != ErrCreateRateLimited {
+		t.Errorf("expected ErrCreateRateLimited, got %v", err)
+	}
+	// 限流在计算密码哈希之前检查
+	longPassword := strings.Repeat("x", MaxPasswordLength+1)
+	if _, err := manager.CreateRoom("Host", "https://example.com/video", WithCreatorIP("198.51.100.9"), WithRoomPassword(longPassword)); err != ErrCreateRateLimited {
+		t.Errorf("rate limit should be checked before the password, got %v", err)
+	}
+	// 密码无效的请求不占用创建额度
+	if _, err := manager.CreateRoom("Host", "https://example.com/video", WithCreatorIP("198.51.100.10"), WithRoomPassword(longPassword)); err != ErrInvalidPassword {
+		t.Errorf("expected ErrInvalidPassword, got %v", err)
+	}
+	if _, err := manager.CreateRoom("Host", "https://example.com/video", WithCreatorIP("198.51.100.10")); err != nil {
+		t.Fatalf("CreateRoom after an invalid password failed: %v", err)
+	}
+	manager.createLimiter.prune(time.Now().Add(2 * time.Minute))
+	if len(manager.createLimiter.hits) != 0 {
+		t.Errorf("expired rate limit entries should be pruned, got %d", len(manager.createLimiter.hits))
+	}
+
+	// 达到房间总数上限
+	if _, err := manager.CreateRoom("Host", "https://example.com/video"); err != ErrRoomLimitReached {
+		t.Errorf("expected ErrRoomLimitReached, got %v", err)
+	}
+}
+
+func TestOutboundQueueSlowConsumer(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	room.MarkConnected(host.ID)
+	drainKinds(host)
+
+	// 尚未发出的 ROOM_STATE 被最新的一条取代，且排在其它事件之后
+	room.Broadcast(protocol.Envelope{Kind: "ROOM_STATE", Data: 1})
+	room.Broadcast(protocol.Envelope{Kind: "CHAT_MESSAGE", Data: 2})
+	room.Broadcast(protocol.Envelope{Kind: "ROOM_STATE", Data: 3})
+	messages, _, _ := host.send.take(nil, outboundHardLimit)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 queued messages, got %d", len(messages))
+	}
+	var last protocol.Envelope
+	data, _ := messages[1].Encode(protocol.JSONCodec)
+	if err := json.Unmarshal(data, &last); err != nil || last.Kind != "ROOM_STATE" || last.Data != float64(3) {
+		t.Errorf("expected latest ROOM_STATE last, got %s %v", last.Kind, last.Data)
+	}
+	if stats := host.DeliveryStats(); stats.Coalesced != 1 {
+		t.Errorf("expected 1 coalesced message, got %d", stats.Coalesced)
+	}
+
+	// 超过软上限后丢弃校时应答，聊天消息仍然保留
+	for i := 0; i < outboundSoftLimit; i++ {
+		host.Send(protocol.Envelope{Kind: "CHAT_MESSAGE", Data: i})
+	}
+	host.Send(protocol.Envelope{Kind: "TIME_PONG"})
+	host.Send(protocol.Envelope{Kind: "CHAT_MESSAGE"})
+	stats := host.DeliveryStats()
+	if stats.Dropped != 1 || stats.Queued != outboundSoftLimit+1 {
+		t.Errorf("expected 1 dropped and %d queued, got %+v", outboundSoftLimit+1, stats)
+	}
+
+	// 超过硬上限后清空队列并标记为慢消费者
+	for i := 0; i < outboundHardLimit; i++ {
+		host.Send(protocol.Envelope{Kind: "CHAT_MESSAGE", Data: i})
+	}
+	if _, _, overflow := host.send.take(nil, outboundHardLimit); !overflow {
+		t.Fatal("queue should overflow past the hard limit")
+	}
+	stats = host.DeliveryStats()
+	if stats.SlowConsumerDisconnects != 1 || stats.Queued != 0 {
+		t.Errorf("expected a slow consumer disconnect with an empty queue, got %+v", stats)
+	}
+
+	// 新连接清除溢出状态，统计通过成员列表提供
+	host.BindConnection(nil, nil, nil)
+	host.Send(protocol.Envelope{Kind: "CHAT_MESSAGE"})
+	if kinds := drainKinds(host); len(kinds) != 1 {
+		t.Errorf("queue should accept messages after reconnect, got %v", kinds)
+	}
+	roster := room.Roster()
+	if len(roster.Participants) != 1 || roster.Participants[0].Delivery == nil || roster.Participants[0].Delivery.SlowConsumerDisconnects != 1 {
+		t.Errorf("roster should expose delivery stats, got %+v", roster.Participants)
+	}
+}
+
+// TestBroadcastSkipsDisconnected 测试断线的参与者不再积压房间事件，重连后只收到新的事件
+func TestBroadcastSkipsDisconnected(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	room, participant, err := manager.LookupParticipant(session.RoomID, viewer.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	room.MarkConnected(viewer.UserID)
+	room.MarkDisconnected(viewer.UserID)
+	drainKinds(participant)
+
+	for i := 0; i < outboundHardLimit+1; i++ {
+		room.Broadcast(protocol.Envelope{Kind: "CHAT_MESSAGE", Data: i})
+	}
+	if kinds := drainKinds(participant); len(kinds) != 0 {
+		t.Errorf("disconnected participant should not queue events, got %d", len(kinds))
+	}
+	if stats := participant.DeliveryStats(); stats.SlowConsumerDisconnects != 0 || stats.Dropped != 0 {
+		t.Errorf("offline time should not count as slow consumption, got %+v", stats)
+	}
+
+	room.MarkConnected(viewer.UserID)
+	drainKinds(participant)
+	room.Broadcast(protocol.Envelope{Kind: "CHAT_MESSAGE"})
+	if kinds := drainKinds(participant); len(kinds) != 1 || kinds[0] != "CHAT_MESSAGE" {
+		t.Errorf("reconnected participant should receive new events only, got %v", kinds)
+	}
+}
+
+// discardConn 丢弃写入内容的 frameWriter，记录写出的帧数
+type discardConn struct {
+	frames int
+}
+
+// discardFrame discardConn 的 NextWriter，与真实连接一样复用同一个写入器
+type discardFrame struct {
+	conn *discardConn
+}
+
+func (f discardFrame) Write(data []byte) (int, error) { return len(data), nil }
+
+func (f discardFrame) Close() error {
+	f.conn.frames++
+	return nil
+}
+
+func (c *discardConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *discardConn) WriteMessage(_ int, data []byte) error {
+	c.frames++
+	return nil
+}
+
+func (c *discardConn) NextWriter(int) (io.WriteCloser, error) {
+	return discardFrame{conn: c}, nil
+}
+
+// frameBuffer 缓存 NextWriter 写入的内容，Close 时作为一帧交给 done
+type frameBuffer struct {
+	bytes.Buffer
+	done func(data []byte)
+}
+
+func (f *frameBuffer) Close() error {
+	f.done(f.Bytes())
+	return nil
+}
+
+// recordConn 记录每一帧的类型与内容的 frameWriter
+type recordConn struct {
+	types  []int
+	frames [][]byte
+}
+
+func (c *recordConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *recordConn) WriteMessage(messageType int, data []byte) error {
+	c.types = append(c.types, messageType)
+	c.frames = append(c.frames, append([]byte(nil), data...))
+	return nil
+}
+
+func (c *recordConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &frameBuffer{done: func(data []byte) {
+		c.types = append(c.types, messageType)
+		c.frames = append(c.frames, append([]byte(nil), data...))
+	}}, nil
+}
+
+func TestSendBatchCoalesced(t *testing.T) {
+	room := NewRoom("room_1", "user_1", "https://example.com/video", time.Now().UTC())
+	if err := room.AttachParticipant("user_1", "Host", true); err != nil {
+		t.Fatalf("AttachParticipant failed: %v", err)
+	}
+	p := room.Participants["user_1"]
+	messages := []*Message{
+		newMessage(protocol.Envelope{Kind: "ROOM_STATE", Seq: 1, Data: protocol.RoomStatePayload{Room: room.StateSnapshot()}}),
+		newMessage(protocol.Envelope{Kind: "CHAT_MESSAGE", Seq: 2, Data: protocol.ChatMessage{ID: "m1", Text: "hi"}}),
+		newMessage(protocol.Envelope{Kind: "CHAT_MESSAGE", Seq: 3, Data: protocol.ChatMessage{ID: "m2", Text: "there"}}),
+	}
+
+	perFrame := &recordConn{}
+	if err := p.sendBatch(perFrame, protocol.JSONCodec, messages, DefaultWriteWait, false); err != nil {
+		t.Fatalf("sendBatch failed: %v", err)
+	}
+	if len(perFrame.frames) != len(messages) {
+		t.Fatalf("expected one frame per message without batch, got %d", len(perFrame.frames))
+	}
+
+	single := &recordConn{}
+	if err := p.sendBatch(single, protocol.JSONCodec, messages[:1], DefaultWriteWait, true); err != nil {
+		t.Fatalf("sendBatch failed: %v", err)
+	}
+	if len(single.frames) != 1 || single.frames[0][0] != '{' {
+		t.Fatalf("single message should stay a plain envelope, got %q", single.frames)
+	}
+
+	for _, codec := range []protocol.Codec{protocol.JSONCodec, protocol.MsgpackCodec} {
+		conn := &recordConn{}
+		if err := p.sendBatch(conn, codec, messages, DefaultWriteWait, true); err != nil {
+			t.Fatalf("%s: sendBatch failed: %v", codec.Name(), err)
+		}
+		if len(conn.frames) != 1 {
+			t.Fatalf("%s: expected a single coalesced frame, got %d", codec.Name(), len(conn.frames))
+		}
+		wantType := websocket.TextMessage
+		if codec.Binary() {
+			wantType = websocket.BinaryMessage
+		}
+		if conn.types[0] != wantType {
+			t.Errorf("%s: frame type = %d, want %d", codec.Name(), conn.types[0], wantType)
+		}
+		var envelopes []struct {
+			Kind string `json:"kind" msgpack:"kind"`
+			Seq  uint64 `json:"seq" msgpack:"seq"`
+		}
+		var err error
+		if codec.Binary() {
+			err = msgpack.Unmarshal(conn.frames[0], &envelopes)
+		} else {
+			err = json.Unmarshal(conn.frames[0], &envelopes)
+		}
+		if err != nil {
+			t.Fatalf("%s: coalesced frame should decode as an envelope array: %v", codec.Name(), err)
+		}
+		if len(envelopes) != 3 || envelopes[0].Kind != "ROOM_STATE" || envelopes[2].Seq != 3 {
+			t.Errorf("%s: unexpected envelopes %+v", codec.Name(), envelopes)
+		}
+	}
+}
+
+// sendBatchRoundTrip 旧的写出方式：每条消息反序列化后再由 WriteJSON 重新序列化，作为基准对照
+func sendBatchRoundTrip(conn *discardConn, messages []*Message) error {
+	for _, msg := range messages {
+		data, err := msg.Encode(protocol.JSONCodec)
+		if err != nil {
+			return err
+		}
+		var envelope interface{}
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(envelope)
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteMessage(1, encoded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchmarkBroadcast 每次广播一条 ROOM_STATE 与 events-1 条聊天消息并让每个参与者写出；
+// mode 为 direct（每条消息一帧）、coalesced（合并为一帧）或 roundtrip（旧的写出方式）
+func benchmarkBroadcast(b *testing.B, participants, events int, mode string) {
+	room := NewRoom("bench", "host", "https://example.com/video", time.Now())
+	for i := 0; i < participants; i++ {
+		if err := room.AttachParticipant(fmt.Sprintf("user-%d", i), "Viewer", i == 0); err != nil {
+			b.Fatalf("AttachParticipant failed: %v", err)
+		}
+	}
+	members := make([]*Participant, 0, participants)
+	for _, p := range room.Participants {
+		members = append(members, p)
+	}
+	conn := &discardConn{}
+	envelopes := []protocol.Envelope{{Kind: "ROOM_STATE", Data: protocol.RoomStatePayload{Room: room.StateSnapshot()}}}
+	for i := 1; i < events; i++ {
+		envelopes = append(envelopes, protocol.Envelope{Kind: "CHAT_MESSAGE", Data: protocol.ChatMessage{
+			ID: fmt.Sprintf("msg-%d", i), SenderID: "user-0", DisplayName: "Viewer", Text: "hello", SentAt: time.Now(),
+		}})
+	}
+	batch := make([]*Message, 0, 16)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, envelope := range envelopes {
+			room.Broadcast(envelope)
+		}
+		for _, p := range members {
+			messages, _, _ := p.send.take(batch[:0], cap(batch))
+			var err error
+			switch mode {
+			case "roundtrip":
+				err = sendBatchRoundTrip(conn, messages)
+			case "coalesced":
+				err = p.sendBatch(conn, protocol.JSONCodec, messages, DefaultWriteWait, true)
+			default:
+				err = p.sendBatch(conn, protocol.JSONCodec, messages, DefaultWriteWait, false)
+			}
+			if err != nil {
+				b.Fatalf("write failed: %v", err)
+			}
+		}
+	}
+	b.ReportMetric(float64(conn.frames)/float64(b.N)/float64(participants), "frames/conn")
+}
+
+func BenchmarkBroadcastWrite(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		for _, events := range []int{1, 8} {
+			for _, mode := range []string{"direct", "coalesced", "roundtrip"} {
+				n, events, mode := n, events, mode
+				b.Run(fmt.Sprintf("participants=%d/events=%d/%s", n, events, mode), func(b *testing.B) {
+					benchmarkBroadcast(b, n, events, mode)
+				})
+			}
+		}
+	}
+}
+
+func TestMixedCodecs(t *testing.T) {
+	room := NewRoom("room_1", "user_1", "https://example.com/video", time.Now().UTC())
+	if err := room.AttachParticipant("user_1", "Host", true); err != nil {
+		t.Fatalf("AttachParticipant failed: %v", err)
+	}
+	if err := room.AttachParticipant("user_2", "Viewer", false); err != nil {
+		t.Fatalf("AttachParticipant failed: %v", err)
+	}
+	room.Participants["user_1"].BindConnection(nil, protocol.JSONCodec, nil)
+	room.Participants["user_2"].BindConnection(nil, protocol.MsgpackCodec, nil)
+	room.MarkConnected("user_1")
+	room.MarkConnected("user_2")
+	drainKinds(room.Participants["user_1"])
+	drainKinds(room.Participants["user_2"])
+
+	room.Broadcast(protocol.Envelope{Kind: "ROOM_STATE", Data: protocol.RoomStatePayload{Room: room.StateSnapshot()}})
+	jsonBatch, _, _ := room.Participants["user_1"].send.take(nil, outboundHardLimit)
+	packBatch, _, _ := room.Participants["user_2"].send.take(nil, outboundHardLimit)
+	if len(jsonBatch) != 1 || len(packBatch) != 1 || jsonBatch[0] != packBatch[0] {
+		t.Fatal("participants should share the same broadcast message")
+	}
+
+	// 每种编码只序列化一次
+	message := jsonBatch[0]
+	for i := 0; i < 3; i++ {
+		if _, err := message.Encode(protocol.MsgpackCodec); err != nil {
+			t.Fatalf("msgpack encode failed: %v", err)
+		}
+		if _, err := message.Encode(protocol.JSONCodec); err != nil {
+			t.Fatalf("json encode failed: %v", err)
+		}
+	}
+	if len(message.encoded) != 2 {
+		t.Errorf("expected one encoding per codec, got %d", len(message.encoded))
+	}
+
+	// MessagePack 与 JSON 使用相同的字段名，入站消息解析后 Data 为 JSON
+	packed, _ := message.Encode(protocol.MsgpackCodec)
+	inbound, err := protocol.MsgpackCodec.DecodeInbound(packed)
+	if err != nil {
+		t.Fatalf("msgpack decode failed: %v", err)
+	}
+	var payload protocol.RoomStatePayload
+	if err := json.Unmarshal(inbound.Data, &payload); err != nil {
+		t.Fatalf("decoded data should be JSON: %v", err)
+	}
+	if inbound.Kind != "ROOM_STATE" || payload.Room.RoomID != "room_1" || payload.Room.VideoURL != "https://example.com/video" {
+		t.Errorf("unexpected decoded envelope %s %+v", inbound.Kind, payload.Room)
+	}
+
+	if codec := protocol.CodecFor(""); codec != protocol.JSONCodec {
+		t.Errorf("connections without a subprotocol should use JSON, got %s", codec.Name())
+	}
+}
+
+// countingStore 记录 Save 调用次数的内存存储
+type countingStore struct {
+	saves int
+}
+
+func (s *countingStore) Save(*Room) error           { s.saves++; return nil }
+func (s *countingStore) Load(string) (*Room, error) { return nil, ErrRoomNotFound }
+func (s *countingStore) LoadAll() ([]*Room, error)  { return nil, nil }
+func (s *countingStore) Delete(string) error        { return nil }
+
+func TestRejectedRequestsDoNotPersist(t *testing.T) {
+	store := &countingStore{}
+	manager := NewManager(WithStore(store), WithSweepInterval(0))
+	defer manager.Close()
+
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	viewer, err := manager.JoinRoom(session.RoomID, "Viewer")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	saves := store.saves
+	if _, err := room.ApplyControl(viewer.UserID, protocol.ControlMessage{Payload: protocol.ControlPayload{Position: 1}}); err == nil {
+		t.Fatal("viewer control should be rejected")
+	}
+	position := 1.0
+	if _, err := room.ApplyCommand(viewer.UserID, protocol.PlaybackCommand{Type: protocol.CommandSeek, Position: &position}); err == nil {
+		t.Fatal("viewer command should be rejected")
+	}
+	if _, err := room.CreateInvite(viewer.UserID, 0, 0); err == nil {
+		t.Fatal("viewer invite should be rejected")
+	}
+	if err := room.attachWithInvite("missing", "user_x", "X", time.Now()); err != ErrInviteNotFound {
+		t.Fatalf("expected ErrInviteNotFound, got %v", err)
+	}
+	if store.saves != saves {
+		t.Errorf("rejected requests should not persist, got %d extra saves", store.saves-saves)
+	}
+
+	if _, err := room.ApplyControl(session.UserID, protocol.ControlMessage{Payload: protocol.ControlPayload{Position: 1}}); err != nil {
+		t.Fatalf("host control failed: %v", err)
+	}
+	if store.saves != saves+1 {
+		t.Errorf("accepted control should persist once, got %d saves", store.saves-saves)
+	}
+}
+
+func TestControlSourceChangeResetsPosition(t *testing.T) {
+	room := NewRoom("room_1", "user_1", "https://example.com/video", time.Now().UTC())
+	if err := room.AttachParticipant("user_1", "Host", true); err != nil {
+		t.Fatalf("AttachParticipant failed: %v", err)
+	}
+	playing := true
+	if _, err := room.ApplyControl("user_1", protocol.ControlMessage{
+		Payload: protocol.ControlPayload{Position: 120, Playing: &playing},
+	}); err != nil {
+		t.Fatalf("ApplyControl failed: %v", err)
+	}
+
+	// 旧版客户端切换片源时仍会带上旧进度，应从头开始
+	videoURL := "https://example.com/other"
+	state, err := room.ApplyControl("user_1", protocol.ControlMessage{
+		Payload: protocol.ControlPayload{Position: 120, VideoURL: &videoURL},
+	})
+	if err != nil {
+		t.Fatalf("ApplyControl failed: %v", err)
+	}
+	if state.VideoURL != videoURL || state.Position != 0 || state.IsPlaying {
+		t.Errorf("source change should reset to a paused start, got %+v", state)
+	}
+
+	// 同一片源的控制仍使用客户端进度
+	state, err = room.ApplyControl("user_1", protocol.ControlMessage{
+		Payload: protocol.ControlPayload{Position: 30, VideoURL: &videoURL},
+	})
+	if err != nil {
+		t.Fatalf("ApplyControl failed: %v", err)
+	}
+	if state.Position != 30 {
+		t.Errorf("expected position 30, got %v", state.Position)
+	}
+}
+
+func TestHostPromotionPrefersCoHost(t *testing.T) {
+	manager := NewManager(WithHostGracePeriod(20*time.Millisecond), WithSweepInterval(0))
+	defer manager.Close()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, host, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+	var ids []string
+	for _, name := range []string{"Spectator", "Viewer", "CoHost"} {
+		joined, err := manager.JoinRoom(session.RoomID, name)
+		if err != nil {
+			t.Fatalf("JoinRoom failed: %v", err)
+		}
+		ids = append(ids, joined.UserID)
+	}
+	if _, err := room.GrantRole(host.ID, ids[0], protocol.RoleSpectator); err != nil {
+		t.Fatalf("GrantRole failed: %v", err)
+	}
+	if _, err := room.GrantRole(host.ID, ids[2], protocol.RoleCoHost); err != nil {
+		t.Fatalf("GrantRole failed: %v", err)
+	}
+
+	// 旁观者连接最早，联合主持人连接最晚，仍由联合主持人接任
+	room.MarkConnected(host.ID)
+	for _, id := range ids {
+		room.MarkConnected(id)
+		time.Sleep(time.Millisecond)
+	}
+	room.MarkDisconnected(host.ID)
+
+	deadline := time.Now().Add(time.Second)
+	for room.StateSnapshot().OwnerID == host.ID && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if owner := room.StateSnapshot().OwnerID; owner != ids[2] {
+		t.Errorf("co-host should be promoted, got %s", owner)
+	}
+}
+
+// TestPlaylistSnapshotIsReadOnly 读取播放列表不算房间活动，只有变更才刷新活动时间
+func TestPlaylistSnapshotIsReadOnly(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0))
+	defer manager.Close()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour).UTC()
+	room.mu.Lock()
+	room.LastActiveAt = past
+	room.mu.Unlock()
+	if _, err := manager.GetPlaylist(session.RoomID); err != nil {
+		t.Fatalf("GetPlaylist failed: %v", err)
+	}
+	room.PlaylistSnapshot()
+	room.mu.RLock()
+	lastActive := room.LastActiveAt
+	room.mu.RUnlock()
+	if !lastActive.Equal(past) {
+		t.Errorf("reading the playlist should not touch the room, got %v", lastActive)
+	}
+
+	if _, err := room.AddToPlaylist(session.UserID, "https://example.com/ep1", "", false); err != nil {
+		t.Fatalf("AddToPlaylist failed: %v", err)
+	}
+	room.mu.RLock()
+	lastActive = room.LastActiveAt
+	room.mu.RUnlock()
+	if !lastActive.After(past) {
+		t.Error("adding to the playlist should touch the room")
+	}
+}
+
+// TestClosedRoomStaysDeleted 房间关闭后，持有旧引用的保存与加入都不会把房间写回存储
+func TestClosedRoomStaysDeleted(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	manager := NewManager(WithStore(store), WithSweepInterval(0))
+	defer manager.Close()
+	session, err := manager.CreateRoom("Host", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+	if err != nil {
+		t.Fatalf("LookupParticipant failed: %v", err)
+	}
+
+	manager.CloseRoom(room, protocol.RoomClosedIdle)
+	if err := room.AttachParticipant("user_late", "Late", false); err != ErrRoomNotFound {
+		t.Errorf("attaching to a closed room should fail, got %v", err)
+	}
+	room.persist()
+	if err := store.Save(room); !errors.Is(err, errRoomClosed) {
+		t.Errorf("saving a closed room should be refused, got %v", err)
+	}
+	if _, err := store.Load(session.RoomID); err != ErrRoomNotFound {
+		t.Errorf("closed room should not be written back, got %v", err)
+	}
+	if _, err := manager.JoinRoom(session.RoomID, "Viewer"); err != ErrRoomNotFound {
+		t.Errorf("joining a closed room should fail, got %v", err)
+	}
+}
+
+// deleteHookStore 在删除存储之前调用 beforeDelete，用于模拟与删除并发的请求
+type deleteHookStore struct {
+	*FileStore
+	beforeDelete func(roomID string)
+}
+
+func (s *deleteHookStore) Delete(roomID string) error {
+	if s.beforeDelete != nil {
+		s.beforeDelete(roomID)
+	}
+	return s.FileStore.Delete(roomID)
+}
+
+// TestRemovedRoomNotReloaded 删除房间期间的查找不会从存储重新加载出已关闭的房间
+func TestRemovedRoomNotReloaded(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	store := &deleteHookStore{FileStore: fileStore}
+	manager := NewManager(WithStore(store), WithSweepInterval(0))
+	defer manager.Close()
+
+	for _, name := range []string{"close", "cleanup"} {
+		session, err := manager.CreateRoom("Host", "https://example.com/video")
+		if err != nil {
+			t.Fatalf("%s: CreateRoom failed: %v", name, err)
+		}
+		room, _, err := manager.LookupParticipant(session.RoomID, session.Token)
+		if err != nil {
+			t.Fatalf("%s: LookupParticipant failed: %v", name, err)
+		}
+		store.beforeDelete = func(roomID string) {
+			// 删除过程中的请求只能看到已关闭的房间
+			if _, _, err := manager.LookupParticipant(roomID, session.Token); err == nil {
+				t.Errorf("%s: token should not work while the room is being deleted", name)
+			}
+		}
+		if name == "close" {
+			manager.CloseRoom(room, protocol.RoomClosedIdle)
+		} else {
+			room.DetachParticipant(session.UserID)
+			manager.CleanupRoom(room)
+		}
+		store.beforeDelete = nil
+
+		if !room.isClosed() {
+			t.Errorf("%s: removed room should be marked closed", name)
+		}
+		if _, _, err := manager.LookupParticipant(session.RoomID, session.Token); err != ErrRoomNotFound {
+			t.Errorf("%s: removed room should stay gone, got %v", name, err)
+		}
+		if _, err := store.Load(session.RoomID); err != ErrRoomNotFound {
+			t.Errorf("%s: removed room should not be written back, got %v", name, err)
+		}
+	}
+}
+
+// TestAuthorizeRead 只读接口只对持有本房间令牌且已入场的成员开放
+func TestAuthorizeRead(t *testing.T) {
+	manager := NewManager(WithSweepInterval(0))
+	defer manager.Close()
+	session, err := manager.CreateRoom("Host", "https://example.com/video",
+		WithRoomSettings(protocol.RoomSettings{WaitingRoom: true}))
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	other, err := manager.CreateRoom("Other", "https://example.com/video")
+	if err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	waiting, err := manager.JoinRoom(session.RoomID, "Waiting")
+	if err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+
+	if err := manager.AuthorizeRead(session.RoomID, session.Token); err != nil {
+		t.Errorf("host should be authorized, got %v", err)
+	}
+	if err := manager.AuthorizeRead(session.RoomID, "garbage"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for a malformed token, got %v", err)
+	}
+	if err := manager.AuthorizeRead(session.RoomID, other.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for another room's token, got %v", err)
+	}
+	if err := manager.AuthorizeRead(session.RoomID, waiting.Token); !errors.Is(err, ErrAwaitingAdmission) {
+		t.Errorf("expected ErrAwaitingAdmission for a pending participant, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package rooms
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"wethu/internal/protocol"
+)
+
+var (
+	ErrBanned         = errors.New("banned from this room")
+	ErrMuted          = errors.New("muted in this room")
+	ErrCannotModerate = errors.New("cannot moderate this participant")
+)
+
+// 审计记录的操作类型
+const (
+	AuditKick   = "kick"
+	AuditBan    = "ban"
+	AuditMute   = "mute"
+	AuditUnmute = "unmute"
+)
+
+// auditTrailSize 每个房间保留的审计记录数量
+const auditTrailSize = 200
+
+// roleRank 角色等级，只能管理等级更低的成员
+var roleRank = map[string]int{
+	protocol.RoleOwner:     3,
+	protocol.RoleCoHost:    2,
+	protocol.RoleViewer:    1,
+	protocol.RoleSpectator: 0,
+}
+
+// WithClientIP 记录加入者的 IP，用于封禁后阻止同一来源再次加入，以及限制密码尝试次数。ip 应取连接的对端地址，
+// 只有经过可信代理时才采用转发头（见 hertzapi.SetTrustedProxies），否则客户端可以伪造
+func WithClientIP(ip string) JoinOption {
+	return func(o *joinOptions) {
+		if ip != "" {
+			o.fingerprints = append(o.fingerprints, fingerprintKey("ip", ip))
+			o.clientIP = ip
+		}
+	}
+}
+
+// WithClientFingerprint 记录客户端提供的设备指纹，用途同 WithClientIP；
+// 指纹由客户端自行上报，只能拦住不刻意规避的重新加入
+func WithClientFingerprint(fingerprint string) JoinOption {
+	return func(o *joinOptions) {
+		if fingerprint != "" {
+			o.fingerprints = append(o.fingerprints, fingerprintKey("fp", fingerprint))
+		}
+	}
+}
+
+// fingerprintKey 房间中只保存来源标识的摘要
+func fingerprintKey(kind, value string) string {
+	sum := sha256.Sum256([]byte(kind + ":" + value))
+	return "fp:" + hex.EncodeToString(sum[:])
+}
+
+func userBanKey(userID string) string {
+	return "user:" + userID
+}
+
+// checkBanned 判断加入者的来源是否已被封禁
+func (r *Room) checkBanned(fingerprints []string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, key := range fingerprints {
+		if _, banned := r.Bans[key]; banned {
+			return ErrBanned
+		}
+	}
+	return nil
+}
+
+// setFingerprints 记录参与者的来源摘要
+func (r *Room) setFingerprints(participantID string, fingerprints []string) {
+	if len(fingerprints) == 0 {
+		return
+	}
+	r.mu.Lock()
+	if participant, ok := r.Participants[participantID]; ok {
+		participant.Fingerprints = append([]string(nil), fingerprints...)
+	}
+	r.mu.Unlock()
+	r.persist()
+}
+
+// Kick 把参与者移出房间，通知其原因后断开连接；需要 kick 权限
+func (r *Room) Kick(senderID, targetID, reason string) error {
+	return r.remove(senderID, targetID, reason, false)
+}
+
+// Ban 移出参与者并封禁其用户 ID 与加入时记录的来源；需要 kick 权限。
+// 封禁只是尽力而为：每次 JoinRoom 都会生成新的用户 ID，user: 键只拦住被封禁者手中的旧令牌；
+// 真正阻止重新加入的是来源 IP，换网络或共用出口 IP 时会漏拦或误拦；客户端指纹可以随意更换
+func (r *Room) Ban(senderID, targetID, reason string) error {
+	return r.remove(senderID, targetID, reason, true)
+}
+
+func (r *Room) remove(senderID, targetID, reason string, ban bool) error {
+	r.mu.Lock()
+	sender, target, err := r.moderationTargetLocked(senderID, targetID)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	now := time.Now().UTC()
+	action := AuditKick
+	if ban {
+		action = AuditBan
+		if r.Bans == nil {
+			r.Bans = make(map[string]time.Time)
+		}
+		r.Bans[userBanKey(target.ID)] = now
+		for _, key := range target.Fingerprints {
+			r.Bans[key] = now
+		}
+	}
+	// 先放入发送队列，队列关闭后连接随之断开
+	target.Send(protocol.Envelope{
+		Kind: "KICKED",
+		Data: protocol.Kicked{Reason: reason, By: sender.ID, Banned: ban},
+	})
+	info, _ := r.detachLocked(targetID)
+	r.auditLocked(action, sender, target, reason, now)
+	r.mu.Unlock()
+
+	r.persist()
+	r.Broadcast(protocol.Envelope{Kind: "PARTICIPANT_LEFT", Data: info})
+	return nil
+}
+
+// SetMuted 禁言或解除禁言，禁言期间不能发送聊天消息；需要 kick 权限
+func (r *Room) SetMuted(senderID, targetID string, muted bool, reason string) error {
+	r.mu.Lock()
+	sender, target, err := r.moderationTargetLocked(senderID, targetID)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	if target.Muted == muted {
+		r.mu.Unlock()
+		return nil
+	}
+	target.Muted = muted
+	action := AuditUnmute
+	if muted {
+		action = AuditMute
+	}
+	r.auditLocked(action, sender, target, reason, time.Now().UTC())
+	event := protocol.ParticipantMuted{UserID: target.ID, Muted: muted, By: sender.ID}
+	r.mu.Unlock()
+
+	r.persist()
+	r.Broadcast(protocol.Envelope{Kind: "PARTICIPANT_MUTED", Data: event})
+	return nil
+}
+
+// AuditTrail 返回房间的审计记录，需要 kick 权限
+func (r *Room) AuditTrail(senderID string) ([]protocol.AuditEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, err := r.authorizeLocked(senderID, protocol.PermissionKick); err != nil {
+		return nil, err
+	}
+	return append([]protocol.AuditEntry(nil), r.Audit...), nil
+}
+
+// moderationTargetLocked 校验管理权限，且只能管理角色等级更低的成员，调用方需持有 r.mu
+func (r *Room) moderationTargetLocked(senderID, targetID string) (*Participant, *Participant, error) {
+	sender, err := r.authorizeLocked(senderID, protocol.PermissionKick)
+	if err != nil {
+		return nil, nil, err
+	}
+	target, ok := r.Participants[targetID]
+	if !ok {
+		return nil, nil, ErrParticipantNotFound
+	}
+	if roleRank[roleOf(target)] >= roleRank[roleOf(sender)] {
+		return nil, nil, ErrCannotModerate
+	}
+	return sender, target, nil
+}
+
+// auditLocked 追加一条审计记录，调用方需持有 r.mu
+func (r *Room) auditLocked(action string, actor, target *Participant, reason string, now time.Time) {
+	r.Audit = append(r.Audit, protocol.AuditEntry{
+		Action:     action,
+		ActorID:    actor.ID,
+		ActorName:  actor.Name,
+		TargetID:   target.ID,
+		TargetName: target.Name,
+		Reason:     reason,
+		At:         now,
+	})
+	if overflow := len(r.Audit) - auditTrailSize; overflow > 0 {
+		r.Audit = append([]protocol.AuditEntry(nil), r.Audit[overflow:]...)
+	}
+}
@@ -0,0 +1,197 @@
+package rooms
+
+import (
+	"sync"
+
+	"wethu/internal/protocol"
+)
+
+const (
+	// outboundSoftLimit 队列长度达到该值后丢弃可再生的消息（例如校时应答），聊天与控制事件仍然保留
+	outboundSoftLimit = 64
+	// outboundHardLimit 队列长度超过该值时判定为慢消费者并断开连接，需大于 eventBufferSize 以容纳一次完整补发
+	outboundHardLimit = 512
+)
+
+// coalescedKinds 新消息会取代队列中尚未发出的同类消息，客户端只需要最新的一条
+var coalescedKinds = map[string]bool{
+	"ROOM_STATE":     true,
+	"PLAYLIST_STATE": true,
+}
+
+// sheddableKinds 队列超过 outboundSoftLimit 后直接丢弃的消息，客户端会自行重试或可以通过 REST 重新获取
+var sheddableKinds = map[string]bool{
+	"TIME_PONG": true,
+}
+
+// pushResult 放入出站队列的结果
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	// pushCoalesced 取代了队列中的同类消息
+	pushCoalesced
+	// pushDropped 队列积压过多，消息被丢弃
+	pushDropped
+	// pushOverflow 超过硬上限，队列已清空并等待发送循环断开连接
+	pushOverflow
+	// pushClosed 参与者已被移除
+	pushClosed
+)
+
+// Message 待发送的消息，按编码缓存序列化结果，同一条消息对每种编码最多序列化一次
+type Message struct {
+	envelope protocol.Envelope
+	// fallback 发给未协商 envelope 所属功能的连接的替代消息，为 nil 时这些连接不会收到该消息
+	fallback *Message
+	mu       sync.Mutex
+	encoded  []encodedMessage
+}
+
+type encodedMessage struct {
+	codec string
+	data  []byte
+}
+
+func newMessage(envelope protocol.Envelope) *Message {
+	return &Message{envelope: envelope}
+}
+
+// Encode 返回消息在 codec 下的序列化结果，首次调用时序列化并缓存
+func (m *Message) Encode(codec protocol.Codec) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := codec.Name()
+	for _, encoded := range m.encoded {
+		if encoded.codec == name {
+			return encoded.data, nil
+		}
+	}
+	data, err := codec.Encode(m.envelope)
+	if err != nil {
+		return nil, err
+	}
+	m.encoded = append(m.encoded, encodedMessage{codec: name, data: data})
+	return data, nil
+}
+
+type outboundFrame struct {
+	kind string
+	msg  *Message
+}
+
+// outboundQueue 参与者的出站消息队列，放入操作从不阻塞
+type outboundQueue struct {
+	mu     sync.Mutex
+	frames []outboundFrame
+	// ready 有待发送的消息、队列关闭或溢出时收到信号
+	ready    chan struct{}
+	closed   bool
+	overflow bool
+	stats    protocol.DeliveryStats
+}
+
+func newOutboundQueue() *outboundQueue {
+	return &outboundQueue{ready: make(chan struct{}, 1)}
+}
+
+// push 放入一条消息，kind 为空表示不参与合并与丢弃（例如补发的历史事件）
+func (q *outboundQueue) push(kind string, msg *Message) pushResult {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return pushClosed
+	}
+	if q.overflow {
+		q.stats.Dropped++
+		return pushOverflow
+	}
+
+	result := pushQueued
+	if coalescedKinds[kind] {
+		// 移除旧的同类消息后追加到队尾，保持队列中的序号递增
+		for i, frame := range q.frames {
+			if frame.kind == kind {
+				q.frames = append(q.frames[:i], q.frames[i+1:]...)
+				q.stats.Coalesced++
+				result = pushCoalesced
+				break
+			}
+		}
+	}
+	if result == pushQueued && len(q.frames) >= outboundSoftLimit && sheddableKinds[kind] {
+		q.stats.Dropped++
+		return pushDropped
+	}
+	if len(q.frames) >= outboundHardLimit {
+		q.stats.Dropped += uint64(len(q.frames)) + 1
+		q.stats.SlowConsumerDisconnects++
+		q.frames = nil
+		q.overflow = true
+		q.signal()
+		return pushOverflow
+	}
+
+	q.frames = append(q.frames, outboundFrame{kind: kind, msg: msg})
+	q.signal()
+	return result
+}
+
+// take 取出最多 max 条消息追加到 batch；队列已关闭且为空时 closed 为 true，溢出时 overflow 为 true
+func (q *outboundQueue) take(batch []*Message, max int) (out []*Message, closed, overflow bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.overflow {
+		return batch, false, true
+	}
+	n := len(q.frames)
+	if n > max {
+		n = max
+	}
+	for _, frame := range q.frames[:n] {
+		batch = append(batch, frame.msg)
+	}
+	q.frames = q.frames[n:]
+	if len(q.frames) > 0 {
+		// 还有剩余消息，保持就绪状态
+		q.signal()
+	}
+	if len(q.frames) == 0 {
+		q.frames = nil
+	}
+	return batch, q.closed && len(q.frames) == 0, false
+}
+
+// signal 通知发送循环，调用方需持有 q.mu
+func (q *outboundQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// close 关闭队列，已放入的消息仍可取出
+func (q *outboundQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		q.signal()
+	}
+}
+
+// resetOverflow 新连接建立时清除溢出状态，之后由完整快照恢复客户端状态
+func (q *outboundQueue) resetOverflow() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.overflow = false
+}
+
+// snapshot 返回当前的投递统计
+func (q *outboundQueue) snapshot() protocol.DeliveryStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Queued = len(q.frames)
+	return stats
+}
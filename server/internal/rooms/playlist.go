@@ -0,0 +1,224 @@
+package rooms
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"wethu/internal/protocol"
+)
+
+var (
+	ErrPlaylistItemNotFound = errors.New("playlist item not found")
+	ErrPlaylistFull         = errors.New("playlist is full")
+	ErrPlaylistEmpty        = errors.New("playlist is empty")
+	ErrInvalidPlaylistIndex = errors.New("invalid playlist index")
+	ErrInvalidTitle         = errors.New("playlist title is too long")
+)
+
+const (
+	// MaxPlaylistItems 每个房间播放列表的最大条目数
+	MaxPlaylistItems = 200
+	// maxPlaylistTitleLength 条目标题的最大字符数
+	maxPlaylistTitleLength = 200
+)
+
+// AddToPlaylist 向播放列表追加条目，playNext 为 true 时插到队首
+func (r *Room) AddToPlaylist(senderID, videoURL, title string, playNext bool) (protocol.PlaylistItem, error) {
+	if err := validateVideoURL(videoURL); err != nil {
+		return protocol.PlaylistItem{}, err
+	}
+	title = strings.TrimSpace(title)
+	if utf8.RuneCountInString(title) > maxPlaylistTitleLength {
+		return protocol.PlaylistItem{}, ErrInvalidTitle
+	}
+
+	r.mu.Lock()
+	sender, err := r.authorizeLocked(senderID, protocol.PermissionManagePlaylist)
+	if err != nil {
+		r.mu.Unlock()
+		return protocol.PlaylistItem{}, err
+	}
+	if len(r.Playlist) >= MaxPlaylistItems {
+		r.mu.Unlock()
+		return protocol.PlaylistItem{}, ErrPlaylistFull
+	}
+	r.PlaylistCount++
+	item := protocol.PlaylistItem{
+		ID:       fmt.Sprintf("item_%d", r.PlaylistCount),
+		VideoURL: videoURL,
+		Title:    title,
+		AddedBy:  sender.ID,
+		AddedAt:  time.Now().UTC(),
+	}
+	if playNext {
+		r.Playlist = append([]protocol.PlaylistItem{item}, r.Playlist...)
+	} else {
+		r.Playlist = append(r.Playlist, item)
+	}
+	r.touchLocked(item.AddedAt)
+	playlist := r.playlistLocked()
+	r.mu.Unlock()
+
+	r.publishPlaylist(playlist)
+	return item, nil
+}
+
+// RemoveFromPlaylist 从播放列表中移除条目
+func (r *Room) RemoveFromPlaylist(senderID, itemID string) error {
+	r.mu.Lock()
+	if _, err := r.authorizeLocked(senderID, protocol.PermissionManagePlaylist); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	index := r.playlistIndexLocked(itemID)
+	if index < 0 {
+		r.mu.Unlock()
+		return ErrPlaylistItemNotFound
+	}
+	r.Playlist = append(r.Playlist[:index], r.Playlist[index+1:]...)
+	r.touchLocked(time.Now())
+	playlist := r.playlistLocked()
+	r.mu.Unlock()
+
+	r.publishPlaylist(playlist)
+	return nil
+}
+
+// MovePlaylistItem 将条目移动到 index 位置（从 0 开始）
+func (r *Room) MovePlaylistItem(senderID, itemID string, index int) error {
+	r.mu.Lock()
+	if _, err := r.authorizeLocked(senderID, protocol.PermissionManagePlaylist); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	from := r.playlistIndexLocked(itemID)
+	if from < 0 {
+		r.mu.Unlock()
+		return ErrPlaylistItemNotFound
+	}
+	if index < 0 || index >= len(r.Playlist) {
+		r.mu.Unlock()
+		return ErrInvalidPlaylistIndex
+	}
+	item := r.Playlist[from]
+	r.Playlist = append(r.Playlist[:from], r.Playlist[from+1:]...)
+	r.Playlist = append(r.Playlist[:index], append([]protocol.PlaylistItem{item}, r.Playlist[index:]...)...)
+	r.touchLocked(time.Now())
+	playlist := r.playlistLocked()
+	r.mu.Unlock()
+
+	r.publishPlaylist(playlist)
+	return nil
+}
+
+// PlayNow 立即切换到播放列表中的条目，itemID 为空时播放队首；
+// 只想让条目接在当前片源之后播放时，用 AddToPlaylist 的 playNext 插到队首
+func (r *Room) PlayNow(senderID, itemID string) (protocol.PlaybackEvent, error) {
+	r.mu.Lock()
+	// 立即播放会切换片源，需要同时拥有切换片源的权限
+	sender, err := r.authorizeLocked(senderID, protocol.PermissionManagePlaylist, protocol.PermissionChangeSource)
+	if err != nil {
+		r.mu.Unlock()
+		return protocol.PlaybackEvent{}, err
+	}
+	index := 0
+	if itemID != "" {
+		index = r.playlistIndexLocked(itemID)
+		if index < 0 {
+			r.mu.Unlock()
+			return protocol.PlaybackEvent{}, ErrPlaylistItemNotFound
+		}
+	} else if len(r.Playlist) == 0 {
+		r.mu.Unlock()
+		return protocol.PlaybackEvent{}, ErrPlaylistEmpty
+	}
+	event := r.playItemLocked(index, sender)
+	playlist := r.playlistLocked()
+	r.mu.Unlock()
+
+	r.persist()
+	r.BroadcastPlayback(event)
+	r.Broadcast(protocol.Envelope{Kind: "PLAYLIST_STATE", Data: playlist})
+	return event, nil
+}
+
+// MediaEnded 处理客户端上报的播放结束。videoURL 与当前片源一致且列表非空时自动切到下一条，
+// 多个客户端重复上报同一片源只会切换一次；未切换时返回 false
+func (r *Room) MediaEnded(senderID, videoURL string) (protocol.PlaybackEvent, bool, error) {
+	r.mu.Lock()
+	sender, err := r.authorizeLocked(senderID, protocol.PermissionPlay)
+	if err != nil {
+		r.mu.Unlock()
+		return protocol.PlaybackEvent{}, false, err
+	}
+	if videoURL != r.VideoURL || len(r.Playlist) == 0 {
+		r.mu.Unlock()
+		return protocol.PlaybackEvent{}, false, nil
+	}
+	event := r.playItemLocked(0, sender)
+	playlist := r.playlistLocked()
+	r.mu.Unlock()
+
+	r.persist()
+	r.BroadcastPlayback(event)
+	r.Broadcast(protocol.Envelope{Kind: "PLAYLIST_STATE", Data: playlist})
+	return event, true, nil
+}
+
+// PlaylistSnapshot 返回当前播放列表
+func (r *Room) PlaylistSnapshot() protocol.PlaylistState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.playlistLocked()
+}
+
+// playItemLocked 从列表中取出 index 处的条目并从头开始播放，调用方需持有 r.mu
+func (r *Room) playItemLocked(index int, actor *Participant) protocol.PlaybackEvent {
+	item := r.Playlist[index]
+	r.Playlist = append(r.Playlist[:index], r.Playlist[index+1:]...)
+
+	now := time.Now()
+	r.VideoURL = item.VideoURL
+	r.Position = 0
+	r.IsPlaying = true
+	r.AnchorAt = now
+	r.UpdatedAt = now.UTC()
+	r.Revision++
+	r.touchLocked(now)
+
+	position := 0.0
+	return protocol.PlaybackEvent{
+		Command: protocol.PlaybackCommand{
+			Type:     protocol.CommandChangeSource,
+			Position: &position,
+			Rate:     r.rate(),
+			VideoURL: item.VideoURL,
+		},
+		ActorID:   actor.ID,
+		ActorName: actor.Name,
+		State:     r.stateLocked(now),
+	}
+}
+
+func (r *Room) playlistIndexLocked(itemID string) int {
+	for i, item := range r.Playlist {
+		if item.ID == itemID {
+			return i
+		}
+	}
+	return -1
+}
+
+// playlistLocked 复制播放列表，调用方需持有 r.mu（读锁即可）
+func (r *Room) playlistLocked() protocol.PlaylistState {
+	return protocol.PlaylistState{Items: append([]protocol.PlaylistItem{}, r.Playlist...)}
+}
+
+// publishPlaylist 持久化并广播播放列表
+func (r *Room) publishPlaylist(playlist protocol.PlaylistState) {
+	r.persist()
+	r.Broadcast(protocol.Envelope{Kind: "PLAYLIST_STATE", Data: playlist})
+}
@@ -0,0 +1,160 @@
+package rooms
+
+import (
+	"sort"
+	"time"
+
+	"wethu/internal/protocol"
+)
+
+// MarkConnected 记录参与者建立了 WebSocket 连接，首次上线时广播 PARTICIPANT_JOINED
+func (r *Room) MarkConnected(participantID string) {
+	r.mu.Lock()
+	participant, ok := r.Participants[participantID]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	participant.connections++
+	if participant.connections > 1 {
+		// 同一参与者的额外连接（重连时旧连接尚未断开）不重复通知
+		r.mu.Unlock()
+		return
+	}
+	participant.connectedAt = time.Now().UTC()
+	r.touchLocked(participant.connectedAt)
+	r.emptySince = time.Time{}
+	participant.status = protocol.ParticipantConnected
+	participant.disconnectedAt = time.Time{}
+	if participant.Pending {
+		// 等候室中的参与者入场后才会通知其他成员
+		r.mu.Unlock()
+		return
+	}
+	if participant.IsHost {
+		r.onHostConnectedLocked()
+	} else {
+		r.onViewerConnectedLocked()
+	}
+	info := participantInfo(participant)
+	r.mu.Unlock()
+
+	r.Broadcast(protocol.Envelope{Kind: "PARTICIPANT_JOINED", Data: info})
+}
+
+// MarkDisconnected 记录参与者断开了一个连接，全部断开时广播 PARTICIPANT_LEFT；
+// 房主断开时还会按房间设置暂停并启动移交计时
+func (r *Room) MarkDisconnected(participantID string) {
+	var pausedState *protocol.RoomState
+
+	r.mu.Lock()
+	participant, ok := r.Participants[participantID]
+	if !ok || participant.connections == 0 {
+		r.mu.Unlock()
+		return
+	}
+	participant.connections--
+	if participant.connections > 0 {
+		r.mu.Unlock()
+		return
+	}
+	// 进入重连宽限期，过期后由 SweepDisconnected 移除
+	now := time.Now()
+	participant.status = protocol.ParticipantDisconnected
+	participant.disconnectedAt = now
+	if r.connectedCountLocked() == 0 {
+		r.emptySince = now
+	}
+	if participant.Pending {
+		r.mu.Unlock()
+		return
+	}
+	if participant.IsHost {
+		pausedState = r.onHostDisconnectedLocked(now)
+	}
+	info := participantInfo(participant)
+	r.mu.Unlock()
+
+	r.Broadcast(protocol.Envelope{Kind: "PARTICIPANT_LEFT", Data: info})
+	if pausedState != nil {
+		r.persist()
+		r.Broadcast(protocol.Envelope{
+			Kind: "ROOM_STATE",
+			Data: protocol.RoomStatePayload{Room: *pausedState},
+		})
+	}
+}
+
+// SweepDisconnected 移除断线超过 grace 仍未重连的参与者，返回被移除的数量
+func (r *Room) SweepDisconnected(now time.Time, grace time.Duration) int {
+	r.mu.Lock()
+	var removed []protocol.ParticipantInfo
+	var withdrawn []string
+	for id, participant := range r.Participants {
+		if participant.status != protocol.ParticipantDisconnected || now.Sub(participant.disconnectedAt) < grace {
+			continue
+		}
+		pending := participant.Pending
+		if info, ok := r.detachLocked(id); ok {
+			if pending {
+				withdrawn = append(withdrawn, id)
+			} else {
+				removed = append(removed, info)
+			}
+		}
+	}
+	var admitters []*Participant
+	if len(withdrawn) > 0 {
+		admitters = r.admittersLocked()
+	}
+	r.mu.Unlock()
+
+	if len(removed)+len(withdrawn) == 0 {
+		return 0
+	}
+	r.persist()
+	for _, info := range removed {
+		r.Broadcast(protocol.Envelope{Kind: "PARTICIPANT_LEFT", Data: info})
+	}
+	for _, id := range withdrawn {
+		r.notifyResolved(admitters, protocol.JoinRequestResolved{UserID: id, Reason: AdmissionLeft})
+	}
+	return len(removed) + len(withdrawn)
+}
+
+// Roster 返回房间成员列表及各成员的投递统计，按上线时间排序
+func (r *Room) Roster() protocol.Roster {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	roster := protocol.Roster{Participants: make([]protocol.ParticipantInfo, 0, len(r.Participants))}
+	for _, participant := range r.Participants {
+		if participant.Pending {
+			continue
+		}
+		info := participantInfo(participant)
+		stats := participant.DeliveryStats()
+		info.Delivery = &stats
+		roster.Participants = append(roster.Participants, info)
+	}
+	sort.Slice(roster.Participants, func(i, j int) bool {
+		a, b := roster.Participants[i], roster.Participants[j]
+		if !a.ConnectedSince.Equal(b.ConnectedSince) {
+			return a.ConnectedSince.Before(b.ConnectedSince)
+		}
+		return a.ID < b.ID
+	})
+	return roster
+}
+
+// participantInfo 生成对外展示的成员信息，调用方需持有 r.mu
+func participantInfo(p *Participant) protocol.ParticipantInfo {
+	return protocol.ParticipantInfo{
+		ID:             p.ID,
+		Name:           p.Name,
+		Role:           roleOf(p),
+		Status:         p.status,
+		ConnectedSince: p.connectedAt,
+		Muted:          p.Muted,
+	}
+}
@@ -0,0 +1,217 @@
+package rooms
+
+import (
+	"errors"
+	"fmt"
+
+	"wethu/internal/protocol"
+)
+
+var (
+	ErrInvalidRole       = errors.New("invalid role")
+	ErrInvalidPermission = errors.New("invalid permission")
+	ErrOwnerRoleLocked   = errors.New("owner role can only change via host transfer")
+)
+
+// PermissionError 参与者缺少执行操作所需的权限
+type PermissionError struct {
+	Permission string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("missing permission: %s", e.Permission)
+}
+
+// Is 让 errors.Is(err, ErrUnauthorizedControl) 对所有权限错误成立
+func (e *PermissionError) Is(target error) bool {
+	return target == ErrUnauthorizedControl
+}
+
+// allPermissions 全部可分配的权限
+var allPermissions = []string{
+	protocol.PermissionPlay,
+	protocol.PermissionSeek,
+	protocol.PermissionChangeSource,
+	protocol.PermissionManagePlaylist,
+	protocol.PermissionChat,
+	protocol.PermissionKick,
+	protocol.PermissionManageRoles,
+	protocol.PermissionInvite,
+}
+
+// DefaultPermissions 新房间的默认权限矩阵，房主始终拥有全部权限
+func DefaultPermissions() map[string][]string {
+	return map[string][]string{
+		protocol.RoleOwner: append([]string(nil), allPermissions...),
+		protocol.RoleCoHost: {
+			protocol.PermissionPlay,
+			protocol.PermissionSeek,
+			protocol.PermissionChangeSource,
+			protocol.PermissionManagePlaylist,
+			protocol.PermissionChat,
+			protocol.PermissionKick,
+			protocol.PermissionInvite,
+		},
+		protocol.RoleViewer:    {protocol.PermissionChat},
+		protocol.RoleSpectator: {},
+	}
+}
+
+func validRole(role string) bool {
+	switch role {
+	case protocol.RoleOwner, protocol.RoleCoHost, protocol.RoleViewer, protocol.RoleSpectator:
+		return true
+	}
+	return false
+}
+
+func validPermission(permission string) bool {
+	for _, p := range allPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// roleOf 返回参与者角色，兼容没有 Role 字段的旧数据
+func roleOf(p *Participant) string {
+	if p.Role != "" {
+		return p.Role
+	}
+	if p.IsHost {
+		return protocol.RoleOwner
+	}
+	return protocol.RoleViewer
+}
+
+// setRole 同时维护 Role 与兼容字段 IsHost
+func (p *Participant) setRole(role string) {
+	p.Role = role
+	p.IsHost = role == protocol.RoleOwner
+}
+
+// hasPermissionLocked 判断参与者是否拥有指定权限，调用方需持有 r.mu
+func (r *Room) hasPermissionLocked(p *Participant, permission string) bool {
+	role := roleOf(p)
+	if role == protocol.RoleOwner {
+		return true
+	}
+	for _, granted := range r.Permissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeLocked 查找参与者并校验权限，调用方需持有 r.mu
+func (r *Room) authorizeLocked(participantID string, permissions ...string) (*Participant, error) {
+	participant, ok := r.Participants[participantID]
+	if !ok {
+		return nil, ErrUnauthorizedControl
+	}
+	if participant.Pending {
+		return nil, ErrAwaitingAdmission
+	}
+	for _, permission := range permissions {
+		if !r.hasPermissionLocked(participant, permission) {
+			return nil, &PermissionError{Permission: permission}
+		}
+	}
+	return participant, nil
+}
+
+// GrantRole 为参与者授予角色；房主身份只能通过 TransferHost 变更
+func (r *Room) GrantRole(senderID, targetID, role string) (protocol.RoleChanged, error) {
+	if !validRole(role) {
+		return protocol.RoleChanged{}, ErrInvalidRole
+	}
+	if role == protocol.RoleOwner {
+		return protocol.RoleChanged{}, ErrOwnerRoleLocked
+	}
+
+	r.mu.Lock()
+	sender, err := r.authorizeLocked(senderID, protocol.PermissionManageRoles)
+	if err != nil {
+		r.mu.Unlock()
+		return protocol.RoleChanged{}, err
+	}
+	target, ok := r.Participants[targetID]
+	if !ok || target.Pending {
+		r.mu.Unlock()
+		return protocol.RoleChanged{}, ErrParticipantNotFound
+	}
+	if roleOf(target) == protocol.RoleOwner {
+		r.mu.Unlock()
+		return protocol.RoleChanged{}, ErrOwnerRoleLocked
+	}
+	target.setRole(role)
+	event := protocol.RoleChanged{
+		UserID:    target.ID,
+		Role:      role,
+		ChangedBy: sender.ID,
+	}
+	r.mu.Unlock()
+
+	r.persist()
+	r.Broadcast(protocol.Envelope{Kind: "ROLE_CHANGED", Data: event})
+	return event, nil
+}
+
+// RevokeRole 撤销参与者的角色，恢复为普通观众
+func (r *Room) RevokeRole(senderID, targetID string) (protocol.RoleChanged, error) {
+	return r.GrantRole(senderID, targetID, protocol.RoleViewer)
+}
+
+// SetPermissions 修改某个角色的权限集合，房主权限不可修改
+func (r *Room) SetPermissions(senderID, role string, permissions []string) (map[string][]string, error) {
+	if !validRole(role) {
+		return nil, ErrInvalidRole
+	}
+	if role == protocol.RoleOwner {
+		return nil, ErrOwnerRoleLocked
+	}
+	for _, permission := range permissions {
+		if !validPermission(permission) {
+			return nil, ErrInvalidPermission
+		}
+	}
+
+	r.mu.Lock()
+	if _, err := r.authorizeLocked(senderID, protocol.PermissionManageRoles); err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	r.Permissions[role] = append([]string{}, permissions...)
+	matrix := r.permissionsLocked()
+	r.mu.Unlock()
+
+	r.persist()
+	r.Broadcast(protocol.Envelope{
+		Kind: "PERMISSIONS_CHANGED",
+		Data: protocol.PermissionsChanged{Permissions: matrix},
+	})
+	return matrix, nil
+}
+
+// permissionsLocked 复制一份权限矩阵，调用方需持有 r.mu
+func (r *Room) permissionsLocked() map[string][]string {
+	matrix := make(map[string][]string, len(r.Permissions))
+	for role, permissions := range r.Permissions {
+		matrix[role] = append([]string{}, permissions...)
+	}
+	return matrix
+}
+
+// commandPermission 返回播放命令所需的权限
+func commandPermission(cmdType string) string {
+	switch cmdType {
+	case protocol.CommandSeek, protocol.CommandSetRate:
+		return protocol.PermissionSeek
+	case protocol.CommandChangeSource:
+		return protocol.PermissionChangeSource
+	default:
+		return protocol.PermissionPlay
+	}
+}
@@ -2,10 +2,11 @@ package rooms
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"github.com/RanFeng/ilog"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hertz-contrib/websocket"
@@ -15,6 +16,19 @@ import (
 
 var (
 	ErrUnauthorizedControl = errors.New("only host can control playback")
+	ErrStaleRevision       = errors.New("control is based on a stale revision")
+)
+
+// DefaultWriteWait 向连接写入单条消息的默认超时
+const DefaultWriteWait = 10 * time.Second
+
+const (
+	// seqSaveInterval 广播本身不落盘，存储中的 Seq 落后达到该数量时由广播补存一次，
+	// 因此存储中的 Seq 最多比客户端已收到的序号小 seqSaveInterval
+	seqSaveInterval = 64
+	// seqRestoreGap 从存储恢复房间时序号跳过的数量，大于存储可能落后的数量，
+	// 重启后的序号不会与客户端已收到的重复，旧序号的 RESUME 也不会被误认为已是最新
+	seqRestoreGap = eventBufferSize + seqSaveInterval
 )
 
 type Room struct {
@@ -25,19 +39,72 @@ type Room struct {
 	Position     float64                 `json:"position,omitempty"`
 	UpdatedAt    time.Time               `json:"updated_at"`
 	Participants map[string]*Participant `json:"participants,omitempty"`
-	TokenIndex   map[string]string       `json:"token_index,omitempty"`
-	mu           sync.RWMutex
+	Seq          uint64                  `json:"seq,omitempty"`
+	Revision     uint64                  `json:"revision,omitempty"`
+	PlaybackRate float64                 `json:"playback_rate,omitempty"`
+	AnchorAt     time.Time               `json:"anchor_at"`
+	Settings     protocol.RoomSettings   `json:"settings"`
+	Permissions  map[string][]string     `json:"permissions,omitempty"`
+	ChatHistory  []protocol.ChatMessage  `json:"chat_history,omitempty"`
+	ChatCount    uint64                  `json:"chat_count,omitempty"`
+	Playlist     []protocol.PlaylistItem `json:"playlist,omitempty"`
+	// PlaylistCount 用于生成播放列表条目 ID
+	PlaylistCount uint64    `json:"playlist_count,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastActiveAt  time.Time `json:"last_active_at"`
+	// PasswordHash 房间密码的 bcrypt 哈希，为空表示无需密码
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Invites 邀请码到邀请的索引
+	Invites map[string]*protocol.Invite `json:"invites,omitempty"`
+	// Bans 被封禁的用户 ID（user:）与来源摘要（fp:）及封禁时间
+	Bans map[string]time.Time `json:"bans,omitempty"`
+	// Audit 最近的管理操作记录
+	Audit      []protocol.AuditEntry `json:"audit,omitempty"`
+	mu         sync.RWMutex
+	store      RoomStore
+	events     *eventBuffer
+	hostGrace  time.Duration
+	hostLeftAt time.Time
+	hostTimer  *time.Timer
+	// emptySince 最近一次变为无人在线的时间，有人在线时为零值
+	emptySince time.Time
+	// broadcastMu 保证广播按序号顺序投递
+	broadcastMu sync.Mutex
+	// closed 房间已被关闭，之后不再写入存储也不能加入
+	closed bool
+	// savedSeq 最近一次序列化到存储的 Seq，见 seqSaveInterval
+	savedSeq atomic.Uint64
 }
 
 type Participant struct {
-	ID          string `json:"id,omitempty"`
-	Name        string `json:"name,omitempty"`
-	Token       string `json:"token,omitempty"`
-	IsHost      bool   `json:"is_host,omitempty"`
-	conn        *websocket.Conn
-	send        chan []byte
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	IsHost bool   `json:"is_host,omitempty"`
+	Role   string `json:"role,omitempty"`
+	// TokenVersion 令牌版本，与令牌中的版本不一致时令牌失效
+	TokenVersion uint64 `json:"token_version,omitempty"`
+	// Pending 在等候室中等待审批，期间收不到房间事件也不能操作
+	Pending bool `json:"pending,omitempty"`
+	// Muted 被禁言
+	Muted bool `json:"muted,omitempty"`
+	// Fingerprints 加入时记录的来源摘要，封禁时一并封禁
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	requestedAt  time.Time
+	admitted     chan struct{}
+	conn         *websocket.Conn
+	codec        protocol.Codec
+	// features 当前连接协商的功能，nil 表示未经握手、不过滤事件
+	features    map[string]bool
+	send        *outboundQueue
 	connectedAt time.Time
+	connections int
 	room        *Room
+	// status 连接状态：connected、disconnected（宽限期内可重连）或 gone（已移除）
+	status         string
+	disconnectedAt time.Time
+	// mu 保护 conn、codec、features 与 done
+	mu   sync.Mutex
+	done chan struct{}
 }
 
 func NewRoom(roomID, ownerID, videoURL string, now time.Time) *Room {
@@ -48,32 +115,62 @@ func NewRoom(roomID, ownerID, videoURL string, now time.Time) *Room {
 		IsPlaying:    false,
 		Position:     0,
 		UpdatedAt:    now,
+		PlaybackRate: 1,
+		AnchorAt:     now,
+		CreatedAt:    now,
+		LastActiveAt: now,
 		Participants: make(map[string]*Participant),
-		TokenIndex:   make(map[string]string),
+		Permissions:  DefaultPermissions(),
+		events:       newEventBuffer(eventBufferSize),
+		hostGrace:    DefaultHostGracePeriod,
+		emptySince:   now,
 	}
 	return room
 }
 
-func (r *Room) AttachParticipant(userID, name, token string, isHost bool) error {
+func (r *Room) AttachParticipant(userID, name string, isHost bool) (err error) {
+	defer r.persistOnSuccess(&err)
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	return r.attachLocked(userID, name, isHost)
+}
 
-	if _, exists := r.Participants[userID]; exists {
-		participant := r.Participants[userID]
-		participant.Token = token
+// attachLocked 加入或重新加入参与者，调用方需持有 r.mu
+func (r *Room) attachLocked(userID, name string, isHost bool) error {
+	if r.closed {
+		return ErrRoomNotFound
+	}
+	if participant, exists := r.Participants[userID]; exists {
+		// 重新加入时作废之前签发的令牌
+		participant.TokenVersion++
 		return nil
 	}
 
-	r.Participants[userID] = &Participant{
+	if err := r.checkCapacityLocked(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	r.touchLocked(now)
+	participant := &Participant{
 		ID:          userID,
 		Name:        name,
-		Token:       token,
-		IsHost:      isHost,
-		send:        make(chan []byte, 8),
-		connectedAt: time.Now().UTC(),
+		send:        newOutboundQueue(),
+		connectedAt: now,
 		room:        r,
+		// 加入后尚未建立连接，同样受重连宽限期约束
+		status:         protocol.ParticipantDisconnected,
+		disconnectedAt: now,
+	}
+	if isHost {
+		participant.setRole(protocol.RoleOwner)
+	} else {
+		participant.setRole(protocol.RoleViewer)
+		if r.Settings.WaitingRoom {
+			participant.markPending(now)
+		}
 	}
-	r.TokenIndex[token] = userID
+	r.Participants[userID] = participant
 	if isHost {
 		r.OwnerID = userID
 	}
@@ -81,53 +178,146 @@ func (r *Room) AttachParticipant(userID, name, token string, isHost bool) error
 	return nil
 }
 
-func (r *Room) FindByToken(ctx context.Context, token string) (*Participant, error) {
+// FindByClaims 按已验签的令牌声明查找参与者，参与者已移除或令牌已被轮换时返回 ErrInvalidToken，被封禁时返回 ErrBanned
+func (r *Room) FindByClaims(claims TokenClaims) (*Participant, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	ilog.EventInfo(ctx, "find_room_by_token", "token", token, "room_token", r.TokenIndex)
-	userID, ok := r.TokenIndex[token]
-	if !ok {
-		ilog.EventError(ctx, ErrRoomNotFound, "room not found", "token", token, "room_token", r.TokenIndex)
+	if _, banned := r.Bans[userBanKey(claims.UserID)]; banned {
+		return nil, ErrBanned
+	}
+	participant, ok := r.Participants[claims.UserID]
+	if !ok || participant.TokenVersion != claims.Version {
 		return nil, ErrInvalidToken
 	}
+	return participant, nil
+}
+
+// tokenClaims 生成参与者当前的令牌声明，rotate 为 true 时先递增令牌版本使旧令牌失效
+func (r *Room) tokenClaims(userID string, rotate bool) (TokenClaims, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	participant, ok := r.Participants[userID]
 	if !ok {
-		return nil, ErrParticipantNotFound
+		return TokenClaims{}, ErrParticipantNotFound
 	}
-	return participant, nil
+	if rotate {
+		participant.TokenVersion++
+	}
+	return TokenClaims{
+		RoomID:  r.Id,
+		UserID:  participant.ID,
+		Role:    roleOf(participant),
+		Version: participant.TokenVersion,
+	}, nil
 }
 
 func (r *Room) StateSnapshot() protocol.RoomState {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
+	return r.stateLocked(time.Now())
+}
+
+// stateLocked 生成 now 时刻的房间状态，调用方需持有 r.mu
+func (r *Room) stateLocked(now time.Time) protocol.RoomState {
 	return protocol.RoomState{
-		RoomID:    r.Id,
-		VideoURL:  r.VideoURL,
-		IsPlaying: r.IsPlaying,
-		Position:  r.Position,
-		OwnerID:   r.OwnerID,
-		UpdatedAt: r.UpdatedAt,
+		RoomID:       r.Id,
+		VideoURL:     r.VideoURL,
+		IsPlaying:    r.IsPlaying,
+		Position:     r.positionAt(now),
+		OwnerID:      r.OwnerID,
+		UpdatedAt:    r.UpdatedAt,
+		Revision:     r.Revision,
+		PlaybackRate: r.rate(),
+		Settings:     r.Settings,
+		Permissions:  r.permissionsLocked(),
+		Seq:          r.Seq,
+		ServerTime:   now.UnixMilli(),
+		HasPassword:  r.PasswordHash != "",
+	}
+}
+
+// positionAt 以最近一次控制时的进度和锚点时间推算 now 时刻的播放进度，调用方需持有 r.mu
+func (r *Room) positionAt(now time.Time) float64 {
+	if !r.IsPlaying || r.AnchorAt.IsZero() {
+		return r.Position
+	}
+	elapsed := now.Sub(r.AnchorAt).Seconds()
+	if elapsed <= 0 {
+		return r.Position
+	}
+	return r.Position + elapsed*r.rate()
+}
+
+// rate 返回当前播放速率，未设置时视为 1 倍速
+func (r *Room) rate() float64 {
+	if r.PlaybackRate <= 0 {
+		return 1
 	}
+	return r.PlaybackRate
+}
+
+// checkRevisionLocked 乐观并发校验：未携带版本号时直接通过，调用方需持有 r.mu
+func (r *Room) checkRevisionLocked(base *uint64) error {
+	if base != nil && *base != r.Revision {
+		return ErrStaleRevision
+	}
+	return nil
+}
+
+// DriftAt 返回客户端上报进度相对服务器推算进度的偏差（秒），正数表示客户端超前
+func (r *Room) DriftAt(clientPosition float64, now time.Time) float64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return clientPosition - r.positionAt(now)
+}
+
+// EventsSince 返回序号大于 lastSeq 的已广播事件，间隔过久无法补齐时返回 false
+func (r *Room) EventsSince(lastSeq uint64) ([]*Message, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.events.since(lastSeq, r.Seq)
 }
 
 func (r *Room) Broadcast(envelope protocol.Envelope) {
-	// 预先序列化消息
-	data, err := json.Marshal(envelope)
-	if err != nil {
+	r.broadcast(envelope, nil)
+}
+
+// BroadcastWithFallback 广播依赖协商功能的事件，未协商该功能的连接改为收到 fallback，两者共用同一个序号
+func (r *Room) BroadcastWithFallback(envelope, fallback protocol.Envelope) {
+	r.broadcast(envelope, &fallback)
+}
+
+func (r *Room) broadcast(envelope protocol.Envelope, fallback *protocol.Envelope) {
+	r.broadcastMu.Lock()
+	defer r.broadcastMu.Unlock()
+
+	// 分配序号并预先序列化为 JSON，其它编码由各连接的发送循环按需序列化一次
+	r.mu.Lock()
+	envelope.Seq = r.Seq + 1
+	message := newMessage(envelope)
+	if fallback != nil {
+		fallback.Seq = envelope.Seq
+		message.fallback = newMessage(*fallback)
+	}
+	if _, err := message.Encode(protocol.JSONCodec); err != nil {
+		r.mu.Unlock()
 		ilog.EventError(context.Background(), err, "Failed to marshal broadcast envelope")
 		return
 	}
+	r.Seq = envelope.Seq
+	r.events.append(r.Seq, message)
+	saveSeq := r.store != nil && r.Seq-r.savedSeq.Load() >= seqSaveInterval
 
 	// 复制参与者列表以减少锁持有时间
 	var participants []*Participant
-	r.mu.RLock()
 	for _, p := range r.Participants {
-		if p.send != nil {
+		// 等候室中的参与者收不到房间事件；断线的参与者重连时会重新收到快照，不必为其排队
+		if p.send != nil && !p.Pending && p.connections > 0 {
 			participants = append(participants, p)
 		}
 	}
-	r.mu.RUnlock()
+	r.mu.Unlock()
 
 	// 并发发送消息给多个参与者
 	if len(participants) > 10 {
@@ -142,7 +332,7 @@ func (r *Room) Broadcast(envelope protocol.Envelope) {
 			go func() {
 				defer wg.Done()
 				for p := range workChan {
-					r.sendToParticipant(p, data)
+					r.sendToParticipant(p, envelope.Kind, message)
 				}
 			}()
 		}
@@ -156,23 +346,18 @@ func (r *Room) Broadcast(envelope protocol.Envelope) {
 	} else {
 		// 对于少量参与者，直接发送
 		for _, p := range participants {
-			r.sendToParticipant(p, data)
+			r.sendToParticipant(p, envelope.Kind, message)
 		}
 	}
+	if saveSeq {
+		// 仍持有 broadcastMu，补存完成前不会分配新的序号
+		r.persist()
+	}
 }
 
-// sendToParticipant 安全地向单个参与者发送消息
-func (r *Room) sendToParticipant(p *Participant, data []byte) {
-	select {
-	case p.send <- data:
-		// 消息发送成功
-	default:
-		// 参与者的消息队列已满，可能是客户端处理缓慢或网络问题
-		// 记录警告但不阻塞
-		ilog.EventWarn(context.Background(), "Participant message queue full", "participant_id", p.ID)
-
-		// 可以考虑实现背压机制，如暂时关闭连接或减少消息频率
-	}
+// sendToParticipant 安全地向单个参与者发送消息，不会阻塞
+func (r *Room) sendToParticipant(p *Participant, kind string, message *Message) {
+	p.enqueue(kind, message)
 }
 
 // min 返回两个整数中的较小值
@@ -183,45 +368,72 @@ func min(a, b int) int {
 	return b
 }
 
-func (r *Room) ApplyControl(senderID string, control protocol.ControlMessage) (protocol.RoomState, error) {
+func (r *Room) ApplyControl(senderID string, control protocol.ControlMessage) (_ protocol.RoomState, err error) {
+	if err := validateControl(control.Payload); err != nil {
+		return protocol.RoomState{}, err
+	}
+
+	defer r.persistOnSuccess(&err)
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	participant, ok := r.Participants[senderID]
-	if !ok || !participant.IsHost {
-		return protocol.RoomState{}, ErrUnauthorizedControl
+	// 旧版控制消息总是携带进度，因此同时需要播放与跳转权限
+	permissions := []string{protocol.PermissionPlay, protocol.PermissionSeek}
+	if control.Payload.VideoURL != nil && *control.Payload.VideoURL != r.VideoURL {
+		permissions = append(permissions, protocol.PermissionChangeSource)
+	}
+	if _, err := r.authorizeLocked(senderID, permissions...); err != nil {
+		return protocol.RoomState{}, err
+	}
+	if err := r.checkRevisionLocked(control.Payload.BaseRevision); err != nil {
+		return protocol.RoomState{}, err
 	}
 
+	now := time.Now()
 	r.Position = control.Payload.Position
-	if control.Payload.VideoURL != nil {
+	r.AnchorAt = now
+	if control.Payload.VideoURL != nil && *control.Payload.VideoURL != r.VideoURL {
+		// 与 CHANGE_SOURCE 一致：切换片源后从头开始，未指定播放状态时暂停
 		r.VideoURL = *control.Payload.VideoURL
+		r.Position = 0
+		r.IsPlaying = false
 	}
 	if control.Payload.Playing != nil {
 		r.IsPlaying = *control.Payload.Playing
 	}
-	r.UpdatedAt = control.Payload.IssuedAt
+	if control.Payload.Rate != nil {
+		r.PlaybackRate = *control.Payload.Rate
+	}
+	// 使用服务器时间，避免客户端时钟让 UpdatedAt 倒退
+	r.UpdatedAt = now.UTC()
+	r.Revision++
+	r.touchLocked(now)
 
-	return protocol.RoomState{
-		RoomID:    r.Id,
-		VideoURL:  r.VideoURL,
-		IsPlaying: r.IsPlaying,
-		Position:  r.Position,
-		OwnerID:   r.OwnerID,
-		UpdatedAt: r.UpdatedAt,
-	}, nil
+	return r.stateLocked(now), nil
 }
 
 func (r *Room) DetachParticipant(participantID string) {
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	info, ok := r.detachLocked(participantID)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
 
-	if participant, ok := r.Participants[participantID]; ok {
-		if participant.Token != "" {
-			delete(r.TokenIndex, participant.Token)
-		}
-		close(participant.send)
-		delete(r.Participants, participantID)
+	r.persist()
+	r.Broadcast(protocol.Envelope{Kind: "PARTICIPANT_LEFT", Data: info})
+}
+
+// detachLocked 移除参与者并关闭其发送队列，调用方需持有 r.mu
+func (r *Room) detachLocked(participantID string) (protocol.ParticipantInfo, bool) {
+	participant, ok := r.Participants[participantID]
+	if !ok {
+		return protocol.ParticipantInfo{}, false
 	}
+	participant.status = protocol.ParticipantGone
+	participant.closeSend()
+	delete(r.Participants, participantID)
+	return participantInfo(participant), true
 }
 
 func (r *Room) ParticipantCount() int {
@@ -230,110 +442,269 @@ func (r *Room) ParticipantCount() int {
 	return len(r.Participants)
 }
 
+// isClosed 房间是否已被关闭
+func (r *Room) isClosed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.closed
+}
+
 func (r *Room) ID() string {
 	return r.Id
 }
 
-func (p *Participant) BindConnection(conn *websocket.Conn) {
-	p.conn = conn
+// persist 将房间写入存储，需在释放 r.mu 之后调用；房间已关闭时不再写入
+func (r *Room) persist() {
+	if r.store == nil || r.isClosed() {
+		return
+	}
+	if err := r.store.Save(r); err != nil && !errors.Is(err, errRoomClosed) {
+		ilog.EventError(context.Background(), err, "persist_room_failed", "room", r.Id)
+	}
 }
 
-// SendLoop 发送消息循环
-func (p *Participant) SendLoop() {
-	defer p.Close()
-	// 设置写超时
+// persistOnSuccess 在 *err 为 nil 时写入存储，被拒绝的请求不落盘；
+// 用于 defer，需在 r.mu 的 defer 之前注册，保证释放锁之后才执行
+func (r *Room) persistOnSuccess(err *error) {
+	if *err == nil {
+		r.persist()
+	}
+}
+
+// BindConnection 绑定连接及其协商的编码与功能，codec 为 nil 时使用 JSON；
+// 依赖功能的事件（见 protocol.FeatureForKind）只在 features 包含该功能时发送，features 为 nil 时不过滤
+func (p *Participant) BindConnection(conn *websocket.Conn, codec protocol.Codec, features []string) {
+	if codec == nil {
+		codec = protocol.JSONCodec
+	}
+	var negotiated map[string]bool
+	if features != nil {
+		negotiated = make(map[string]bool, len(features))
+		for _, feature := range features {
+			negotiated[feature] = true
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if p.conn != nil {
-		p.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		// 同一参与者重新连接：通知旧连接的 SendLoop 退出，之后的消息只发往新连接
+		close(p.done)
+	}
+	p.conn = conn
+	p.codec = codec
+	p.features = negotiated
+	p.done = make(chan struct{})
+	if p.send != nil {
+		// 上一个连接因积压被断开时，新连接会重新收到完整快照
+		p.send.resetOverflow()
+	}
+}
+
+// Release 关闭 conn；若它仍是当前绑定的连接，则解除绑定并通知对应的 SendLoop 退出
+func (p *Participant) Release(conn *websocket.Conn) {
+	if conn == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.conn == conn {
+		p.conn = nil
+		close(p.done)
+	}
+	p.mu.Unlock()
+	_ = conn.Close()
+}
+
+// SendLoop 发送消息循环，所绑定的连接被释放、参与者被移除、写入失败或积压超过上限时退出；
+// writeWait 为单条消息的写超时，<=0 时使用 DefaultWriteWait
+func (p *Participant) SendLoop(writeWait time.Duration) {
+	p.mu.Lock()
+	conn, codec, features, done := p.conn, p.codec, p.features, p.done
+	p.mu.Unlock()
+	if conn == nil || p.send == nil {
+		return
+	}
+	defer p.Release(conn)
+	if writeWait <= 0 {
+		writeWait = DefaultWriteWait
 	}
 
-	// 使用缓冲区批量发送消息
-	batchSize := 5
-	messageBatch := make([][]byte, 0, batchSize)
-	timer := time.NewTimer(5 * time.Millisecond)
-	defer timer.Stop()
+	// 每次唤醒时取出已积压的消息批量发送
+	batchSize := 16
+	messageBatch := make([]*Message, 0, batchSize)
 
 	for {
-		timer.Reset(5 * time.Millisecond)
 		select {
-		case data, ok := <-p.send:
-			if !ok {
-				// 通道关闭，发送剩余消息
-				//if len(messageBatch) > 0 && p.conn != nil {
-				//	p.sendBatch(messageBatch)
-				//}
-				return
-			}
+		case <-p.send.ready:
+		case <-done:
+			return
+		}
 
-			if p.conn == nil {
-				continue
+		// 持有 p.mu 取出消息，与 BindConnection 互斥：连接被替换后旧循环不会再取走消息
+		p.mu.Lock()
+		if p.conn != conn {
+			p.mu.Unlock()
+			return
+		}
+		batch, closed, overflow := p.send.take(messageBatch[:0], batchSize)
+		p.mu.Unlock()
+		if overflow {
+			p.closeSlowConsumer(conn, writeWait)
+			return
+		}
+		batch = filterFeatures(batch, features)
+		if len(batch) > 0 {
+			if err := p.sendBatch(conn, codec, batch, writeWait, features[protocol.FeatureBatch]); err != nil {
+				return
 			}
+		}
+		if closed {
+			// 参与者已被移除，剩余消息（例如 ROOM_CLOSED）已发出
+			return
+		}
+	}
+}
 
-			// 添加消息到批次
-			messageBatch = append(messageBatch, data)
-
-			// 如果批次已满，立即发送
-			if len(messageBatch) >= batchSize {
-				if !timer.Stop() {
-					<-timer.C
-				}
-				p.sendBatch(messageBatch)
-				messageBatch = messageBatch[:0]
-			}
+// Negotiated 返回当前连接是否协商了 feature，未经握手绑定（features 为 nil）的连接视为全部支持
+func (p *Participant) Negotiated(feature string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.features == nil || p.features[feature]
+}
 
-		case <-timer.C:
-			// 时间到，发送当前批次
-			if len(messageBatch) > 0 && p.conn != nil {
-				p.sendBatch(messageBatch)
-				messageBatch = messageBatch[:0]
-			}
+// filterFeatures 原地移除连接未协商功能的事件，带 fallback 的事件替换为 fallback；features 为 nil 时原样返回
+func filterFeatures(batch []*Message, features map[string]bool) []*Message {
+	if features == nil {
+		return batch
+	}
+	kept := batch[:0]
+	for _, message := range batch {
+		if feature := protocol.FeatureForKind(message.envelope.Kind); feature == "" || features[feature] {
+			kept = append(kept, message)
+		} else if message.fallback != nil {
+			kept = append(kept, message.fallback)
 		}
 	}
+	return kept
 }
 
-// sendBatch 批量发送消息
-func (p *Participant) sendBatch(messages [][]byte) {
-	for _, data := range messages {
-		// 更新写超时
-		p.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+// closeSlowConsumer 以 slow_consumer 关闭码断开积压过多的连接，参与者随后进入重连宽限期
+func (p *Participant) closeSlowConsumer(conn *websocket.Conn, writeWait time.Duration) {
+	ilog.EventWarn(context.Background(), "Participant slow consumer disconnected", "participant_id", p.ID, "limit", outboundHardLimit)
+	message := websocket.FormatCloseMessage(protocol.CloseSlowConsumer, protocol.CloseReasonSlowConsumer)
+	_ = conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+}
 
-		// 优化：尝试使用WriteJSON直接发送，减少序列化开销
-		var envelope interface{}
-		if err := json.Unmarshal(data, &envelope); err == nil {
-			if err := p.conn.WriteJSON(envelope); err != nil {
-				ilog.EventError(context.Background(), err, "WebSocket: write JSON error")
-				return
-			}
-		} else {
-			// 回退到原始方法
-			if err := p.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				ilog.EventError(context.Background(), err, "WebSocket: write message error")
-				return
-			}
+// frameWriter 发送循环写出消息所需的连接能力，*websocket.Conn 满足该接口
+type frameWriter interface {
+	SetWriteDeadline(t time.Time) error
+	WriteMessage(messageType int, data []byte) error
+	NextWriter(messageType int) (io.WriteCloser, error)
+}
+
+// sendBatch 按连接的编码批量发送消息，整批共用一个写超时；
+// coalesce 为 true（连接协商了 FeatureBatch）时多条消息合并为一帧信封数组一次写出，否则每条消息占一帧
+func (p *Participant) sendBatch(conn frameWriter, codec protocol.Codec, messages []*Message, writeWait time.Duration, coalesce bool) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return err
+	}
+	messageType := websocket.TextMessage
+	if codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	encoded := make([][]byte, 0, len(messages))
+	for _, message := range messages {
+		data, err := message.Encode(codec)
+		if err != nil {
+			ilog.EventError(context.Background(), err, "WebSocket: encode message error", "participant_id", p.ID, "codec", codec.Name())
+			continue
+		}
+		encoded = append(encoded, data)
+	}
+	if coalesce && len(encoded) > 1 {
+		if err := writeCoalesced(conn, codec, messageType, encoded); err != nil {
+			ilog.EventError(context.Background(), err, "WebSocket: write batch error", "participant_id", p.ID, "messages", len(encoded))
+			return err
+		}
+		return nil
+	}
+	for _, data := range encoded {
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			ilog.EventError(context.Background(), err, "WebSocket: write message error", "participant_id", p.ID)
+			return err
 		}
 	}
+	return nil
 }
 
-func (p *Participant) Close() {
-	if p.conn != nil {
-		_ = p.conn.Close()
-		p.conn = nil
+// writeCoalesced 通过 NextWriter 把整批消息写成一帧，Close 时一次刷出
+func writeCoalesced(conn frameWriter, codec protocol.Codec, messageType int, encoded [][]byte) error {
+	w, err := conn.NextWriter(messageType)
+	if err != nil {
+		return err
 	}
+	if err := codec.WriteBatch(w, encoded); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (p *Participant) Close() {
+	p.Release(p.Connection())
 }
 
 func (p *Participant) Connection() *websocket.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.conn
 }
 
-func (p *Participant) Send(envelope protocol.Envelope) {
-	data, err := json.Marshal(envelope)
-	if err != nil {
-		return
+// Status 返回参与者的连接状态
+func (p *Participant) Status() string {
+	p.room.mu.RLock()
+	defer p.room.mu.RUnlock()
+	return p.status
+}
+
+// enqueue 非阻塞地放入发送队列，积压时按消息类型合并或丢弃
+func (p *Participant) enqueue(kind string, message *Message) pushResult {
+	if p.send == nil {
+		return pushClosed
+	}
+	result := p.send.push(kind, message)
+	switch result {
+	case pushDropped:
+		ilog.EventWarn(context.Background(), "Participant message dropped", "participant_id", p.ID, "kind", kind)
+	case pushOverflow:
+		ilog.EventWarn(context.Background(), "Participant message queue overflow", "participant_id", p.ID, "kind", kind)
+	}
+	return result
+}
+
+// closeSend 关闭发送队列，之后的发送都会被忽略
+func (p *Participant) closeSend() {
+	if p.send != nil {
+		p.send.close()
 	}
+}
+
+// DeliveryStats 返回参与者出站队列的投递统计
+func (p *Participant) DeliveryStats() protocol.DeliveryStats {
 	if p.send == nil {
-		return
+		return protocol.DeliveryStats{}
 	}
-	select {
-	case p.send <- data:
-	default:
+	return p.send.snapshot()
+}
+
+// Replay 按顺序补发已序列化的事件，补发的事件不会被合并或丢弃
+func (p *Participant) Replay(events []*Message) {
+	for _, message := range events {
+		if result := p.enqueue("", message); result == pushClosed || result == pushOverflow {
+			return
+		}
 	}
 }
+
+func (p *Participant) Send(envelope protocol.Envelope) {
+	p.enqueue(envelope.Kind, newMessage(envelope))
+}
@@ -0,0 +1,190 @@
+package rooms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"wethu/internal/protocol"
+)
+
+var (
+	ErrInvalidRoomID = errors.New("invalid room id")
+	// errRoomClosed 房间已关闭，Save 不应再写入
+	errRoomClosed = errors.New("room is closed")
+)
+
+// RoomStore 房间持久化存储接口，Manager 通过它在重启后恢复房间
+type RoomStore interface {
+	// Save 保存房间的当前快照（房间及参与者）
+	Save(room *Room) error
+	// Load 读取单个房间，不存在时返回 ErrRoomNotFound
+	Load(roomID string) (*Room, error)
+	// LoadAll 读取全部房间，用于启动时恢复
+	LoadAll() ([]*Room, error)
+	// Delete 删除房间，不存在时不报错
+	Delete(roomID string) error
+}
+
+// roomRecord 用于序列化房间，避免在 Room 上直接递归调用 MarshalJSON
+type roomRecord Room
+
+// MarshalJSON 在读锁保护下序列化房间；房间已关闭时返回 errRoomClosed，
+// 避免与删除并发的保存把房间重新写回存储
+func (r *Room) MarshalJSON() ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil, errRoomClosed
+	}
+	data, err := json.Marshal((*roomRecord)(r))
+	if err == nil {
+		r.savedSeq.Store(r.Seq)
+	}
+	return data, err
+}
+
+// decodeRoom 反序列化房间并重建运行时字段
+func decodeRoom(data []byte) (*Room, error) {
+	room := &Room{}
+	if err := json.Unmarshal(data, (*roomRecord)(room)); err != nil {
+		return nil, err
+	}
+	if room.Participants == nil {
+		room.Participants = make(map[string]*Participant)
+	}
+	if room.Permissions == nil {
+		room.Permissions = DefaultPermissions()
+	}
+	room.events = newEventBuffer(eventBufferSize)
+	// 存储中的 Seq 可能落后于客户端已收到的序号，跳过一段保证序号不倒退
+	room.Seq += seqRestoreGap
+	room.hostGrace = DefaultHostGracePeriod
+	now := time.Now().UTC()
+	room.emptySince = now
+	for id, participant := range room.Participants {
+		if participant == nil {
+			delete(room.Participants, id)
+			continue
+		}
+		// 重启后所有人都处于断线状态，从此刻开始计算重连宽限期
+		participant.status = protocol.ParticipantDisconnected
+		participant.disconnectedAt = now
+		participant.setRole(roleOf(participant))
+		participant.send = newOutboundQueue()
+		participant.room = room
+		if participant.Pending {
+			participant.markPending(now)
+		}
+	}
+	return room, nil
+}
+
+// FileStore 基于本地目录的 RoomStore 实现，每个房间一个 JSON 文件
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore 创建文件存储，目录不存在时自动创建
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create store dir: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(roomID string) (string, error) {
+	if roomID == "" || strings.ContainsAny(roomID, `/\.`) {
+		return "", ErrInvalidRoomID
+	}
+	return filepath.Join(s.dir, roomID+".json"), nil
+}
+
+// Save 先写临时文件再重命名，保证文件内容完整；
+// 序列化与写入都在 s.mu 内进行，并发保存时较晚生成的快照总是最后写入
+func (s *FileStore) Save(room *Room) error {
+	path, err := s.path(room.ID())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileStore) Load(roomID string) (*Room, error) {
+	path, err := s.path(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	data, err := os.ReadFile(path)
+	s.mu.Unlock()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrRoomNotFound
+		}
+		return nil, err
+	}
+	return decodeRoom(data)
+}
+
+func (s *FileStore) LoadAll() ([]*Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Room
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		room, err := decodeRoom(data)
+		if err != nil {
+			return nil, fmt.Errorf("decode %s: %w", entry.Name(), err)
+		}
+		result = append(result, room)
+	}
+	return result, nil
+}
+
+func (s *FileStore) Delete(roomID string) error {
+	path, err := s.path(roomID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
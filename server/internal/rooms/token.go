@@ -0,0 +1,102 @@
+package rooms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTokenExpired = errors.New("token expired")
+)
+
+const (
+	// DefaultTokenTTL 会话令牌默认有效期，过期前可通过刷新接口换发
+	DefaultTokenTTL = 24 * time.Hour
+	// tokenVersionPrefix 令牌格式版本
+	tokenVersionPrefix = "v1"
+	// tokenSecretBytes 未配置密钥时随机生成的密钥长度
+	tokenSecretBytes = 32
+)
+
+// tokenEncoding 严格模式拒绝尾部填充位不规范的编码，同一签名只有一种合法写法
+var tokenEncoding = base64.RawURLEncoding.Strict()
+
+// TokenClaims 会话令牌携带的声明
+type TokenClaims struct {
+	RoomID string `json:"rid"`
+	UserID string `json:"sub"`
+	Role   string `json:"role"`
+	// Version 参与者的令牌版本，刷新后递增，旧令牌随之失效
+	Version   uint64 `json:"ver"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// TokenSigner 使用 HMAC-SHA256 签发和校验会话令牌，
+// 令牌格式为 v1.<base64url(claims)>.<base64url(signature)>
+type TokenSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewTokenSigner 创建令牌签发器，secret 为空时随机生成（重启后旧令牌失效），ttl<=0 时使用默认有效期
+func NewTokenSigner(secret []byte, ttl time.Duration) *TokenSigner {
+	if len(secret) == 0 {
+		secret = randomBytes(tokenSecretBytes)
+	}
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	return &TokenSigner{secret: secret, ttl: ttl}
+}
+
+// Issue 按声明签发令牌，IssuedAt/ExpiresAt 由签发器填写
+func (s *TokenSigner) Issue(claims TokenClaims, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(s.ttl).UTC().Truncate(time.Second)
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = expiresAt.Unix()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signed := tokenVersionPrefix + "." + tokenEncoding.EncodeToString(payload)
+	return signed + "." + tokenEncoding.EncodeToString(s.sign(signed)), expiresAt, nil
+}
+
+// Verify 校验签名与有效期并返回声明
+func (s *TokenSigner) Verify(token string, now time.Time) (TokenClaims, error) {
+	var claims TokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenVersionPrefix {
+		return claims, ErrInvalidToken
+	}
+	signature, err := tokenEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if !hmac.Equal(signature, s.sign(parts[0]+"."+parts[1])) {
+		return claims, ErrInvalidToken
+	}
+	payload, err := tokenEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+func (s *TokenSigner) sign(data string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -71,7 +71,9 @@ export async function joinRoom(roomId: string, displayName: string): Promise<Roo
   };
 }
 
-export async function fetchRoomState(roomId: string): Promise<RoomState> {
-  return request<RoomState>(`${API_BASE}/rooms/${roomId}`);
+export async function fetchRoomState(roomId: string, token: string): Promise<RoomState> {
+  return request<RoomState>(`${API_BASE}/rooms/${roomId}`, {
+    headers: { Authorization: `Bearer ${token}` }
+  });
 }
 
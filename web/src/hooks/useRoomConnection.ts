@@ -1,5 +1,5 @@
 import { useCallback, useEffect, useRef, useState } from 'react';
-import { InboundMessage, OutboundMessage, RoomState } from '@/types/state';
+import { InboundMessage, OutboundMessage, PROTOCOL_VERSION, RoomState } from '@/types/state';
 import { RoomSession } from '@/types/session';
 
 type ConnectionStatus = 'connecting' | 'open' | 'closed' | 'error';
@@ -32,6 +32,17 @@ export function useRoomConnection(session: RoomSession) {
         }
         setStatus('open');
         setError(null);
+        // 握手：服务器收到 HELLO 后才会发送房间状态
+        const hello: OutboundMessage = {
+          kind: 'HELLO',
+          data: {
+            protocolVersion: PROTOCOL_VERSION,
+            client: 'web',
+            // 协商 batch 后服务器会把积压的多条消息合并为一帧信封数组
+            capabilities: ['batch']
+          }
+        };
+        socket.send(JSON.stringify(hello));
         if (!session.isHost) {
           const syncPayload: OutboundMessage = {
             kind: 'SYNC_REQUEST',
@@ -44,34 +55,45 @@ export function useRoomConnection(session: RoomSession) {
         }
       };
 
+      const handleMessage = (message: InboundMessage) => {
+        switch (message.kind) {
+          case 'ROOM_STATE':
+            setRoomState(message.data.room);
+            break;
+          case 'CONTROL':
+            setRoomState((current) => {
+              if (current.updatedAt >= message.data.payload.issuedAt) {
+                return current;
+              }
+              return {
+                ...current,
+                isPlaying: message.data.payload.isPlaying ?? current.isPlaying,
+                position: message.data.payload.position,
+                videoUrl: message.data.payload.videoUrl ?? current.videoUrl,
+                updatedAt: message.data.payload.issuedAt
+              };
+            });
+            break;
+          case 'WELCOME':
+            console.log('WebSocket welcome:', message.data);
+            break;
+          case 'ERROR':
+            if (message.data.code === 'upgrade_required') {
+              setError('客户端版本过旧，请刷新页面后重试');
+              break;
+            }
+            setError(message.data.message);
+            break;
+          default:
+            break;
+        }
+      };
+
       socket.onmessage = (event) => {
         if (!isMounted) return;
         try {
-          const message: InboundMessage = JSON.parse(event.data);
-          switch (message.kind) {
-            case 'ROOM_STATE':
-              setRoomState(message.data.room);
-              break;
-            case 'CONTROL':
-              setRoomState((current) => {
-                if (current.updatedAt >= message.data.payload.issuedAt) {
-                  return current;
-                }
-                return {
-                  ...current,
-                  isPlaying: message.data.payload.isPlaying ?? current.isPlaying,
-                  position: message.data.payload.position,
-                  videoUrl: message.data.payload.videoUrl ?? current.videoUrl,
-                  updatedAt: message.data.payload.issuedAt
-                };
-              });
-              break;
-            case 'ERROR':
-              setError(message.data.message);
-              break;
-            default:
-              break;
-          }
+          const parsed: InboundMessage | InboundMessage[] = JSON.parse(event.data);
+          (Array.isArray(parsed) ? parsed : [parsed]).forEach(handleMessage);
         } catch (err) {
           setError(err instanceof Error ? err.message : '解析服务端消息失败');
         }
@@ -93,6 +115,9 @@ export function useRoomConnection(session: RoomSession) {
         // 如果是401错误，显示未授权错误信息
         if (event.code === 1008) {
           setError('连接被拒绝: 未授权访问，请检查token是否有效');
+        } else if (event.code === 4009) {
+          // 协议版本不兼容，重连也会被拒绝
+          setError('客户端版本过旧，请刷新页面后重试');
         } else if (event.code !== 1000) {
           setError(`连接意外断开: 错误代码 ${event.code}`);
           // Only attempt to reconnect if it wasn't a clean close and component is still mounted
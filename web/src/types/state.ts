@@ -23,6 +23,24 @@ export interface RoomStatePayload {
   room: RoomState;
 }
 
+// 协议版本，连接建立后须先发送 HELLO
+export const PROTOCOL_VERSION = 1;
+
+export interface WelcomePayload {
+  serverVersion: string;
+  protocolVersion: number;
+  codec: string;
+  features: string[];
+  limits: {
+    maxMessageBytes: number;
+    maxChatMessageLength: number;
+    maxPlaylistItems: number;
+    maxParticipants: number;
+    pingIntervalMs: number;
+    pongWaitMs: number;
+  };
+}
+
 export type InboundMessage =
   | {
       kind: 'ROOM_STATE';
@@ -32,15 +50,28 @@ export type InboundMessage =
       kind: 'CONTROL';
       data: ControlMessage;
     }
+  | {
+      kind: 'WELCOME';
+      data: WelcomePayload;
+    }
   | {
       kind: 'ERROR';
       data: {
         code: string;
         message: string;
+        minProtocolVersion?: number;
       };
     };
 
 export type OutboundMessage =
+  | {
+      kind: 'HELLO';
+      data: {
+        protocolVersion: number;
+        client?: string;
+        capabilities?: string[];
+      };
+    }
   | {
       kind: 'CONTROL';
       data: ControlMessage;